@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// adminSSHClient is the representation of a pooled ssh client in the
+// admin API.
+type adminSSHClient struct {
+	Host               string              `json:"host"`
+	JumpHost           string              `json:"jump_host,omitempty"`
+	ConnectedAt        time.Time           `json:"connected_at"`
+	InflightChannels   int64               `json:"inflight_channels"`
+	LastKeepaliveRTT   *float64            `json:"last_keepalive_rtt_seconds"`
+	HostKeyFingerprint string              `json:"host_key_fingerprint"`
+	Algorithms         *adminSSHAlgorithms `json:"algorithms,omitempty"`
+}
+
+type adminSSHAlgorithms struct {
+	KeyExchange string `json:"kex"`
+	HostKey     string `json:"host_key"`
+	ReadCipher  string `json:"read_cipher"`
+	ReadMAC     string `json:"read_mac,omitempty"`
+	WriteCipher string `json:"write_cipher"`
+	WriteMAC    string `json:"write_mac,omitempty"`
+}
+
+// registerAdminAPI adds the endpoints for inspecting and managing the
+// ssh connection pool:
+//
+//	GET  /api/v1/ssh/clients                  lists all pooled clients
+//	POST /api/v1/ssh/clients/{host}/close     closes the clients of host right away
+//	POST /api/v1/ssh/clients/{host}/reconnect replaces the clients of host
+//	POST /api/v1/ssh/clients/flush            removes all clients from the pool
+func (t *sshTransport) registerAdminAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/ssh/clients", t.adminListClients)
+	mux.HandleFunc("POST /api/v1/ssh/clients/{host}/close", t.adminCloseHost)
+	mux.HandleFunc("POST /api/v1/ssh/clients/{host}/reconnect", t.adminReconnectHost)
+	mux.HandleFunc("POST /api/v1/ssh/clients/flush", t.adminFlush)
+}
+
+func (t *sshTransport) adminListClients(rw http.ResponseWriter, req *http.Request) {
+	hosts := make(map[*trackingSSHClient]string)
+	pool := t.sshClientPool.all()
+	for host, clients := range pool {
+		for _, client := range clients {
+			hosts[client] = host
+		}
+	}
+	list := []adminSSHClient{}
+	for host, clients := range pool {
+		for _, client := range clients {
+			list = append(list, newAdminSSHClient(host, client, hosts[client.jumpClient]))
+		}
+	}
+	slices.SortFunc(list, func(a, b adminSSHClient) int {
+		if c := strings.Compare(a.Host, b.Host); c != 0 {
+			return c
+		}
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+	writeAdminResponse(rw, list)
+}
+
+func newAdminSSHClient(host string, client *trackingSSHClient, jumpHost string) adminSSHClient {
+	client.mtx.Lock()
+	inflight, rtt := client.inflightConns, client.keepaliveRTT
+	client.mtx.Unlock()
+	c := adminSSHClient{
+		Host:             host,
+		JumpHost:         jumpHost,
+		ConnectedAt:      client.createdAt,
+		InflightChannels: inflight,
+	}
+	if rtt > 0 {
+		seconds := rtt.Seconds()
+		c.LastKeepaliveRTT = &seconds
+	}
+	if client.hostKey != nil {
+		c.HostKeyFingerprint = ssh.FingerprintSHA256(client.hostKey)
+	}
+	if conn, ok := client.Client.Conn.(ssh.AlgorithmsConnMetadata); ok {
+		algos := conn.Algorithms()
+		c.Algorithms = &adminSSHAlgorithms{
+			KeyExchange: algos.KeyExchange,
+			HostKey:     algos.HostKey,
+			ReadCipher:  algos.Read.Cipher,
+			ReadMAC:     algos.Read.MAC,
+			WriteCipher: algos.Write.Cipher,
+			WriteMAC:    algos.Write.MAC,
+		}
+	}
+	return c
+}
+
+// adminCloseHost closes all clients of a host immediately, aborting
+// their inflight channels. This is meant for wedged connections.
+func (t *sshTransport) adminCloseHost(rw http.ResponseWriter, req *http.Request) {
+	host := strings.ToLower(req.PathValue("host"))
+	clients := t.sshClientPool.deleteHost(host)
+	for _, client := range clients {
+		_ = client.forceClose()
+		metricSSHClientEvictionsTotal.WithLabelValues("admin").Inc()
+		for dependent, dependentHost := range t.sshClientPool.deleteDependents(client) {
+			log.WithFields(log.Fields{"host": dependentHost, "jumpHost": host}).Debug("dropping ssh connection via closed jump host")
+			_ = dependent.CloseWhenFinished()
+			metricSSHClientEvictionsTotal.WithLabelValues("jump_host_failure").Inc()
+		}
+	}
+	log.WithFields(log.Fields{"host": host, "clients": len(clients)}).Info("closed ssh connections via admin API")
+	writeAdminResponse(rw, map[string]int{"closed": len(clients)})
+}
+
+// adminReconnectHost replaces all clients of a host with a new one.
+// The old clients are closed once their inflight channels have finished.
+func (t *sshTransport) adminReconnectHost(rw http.ResponseWriter, req *http.Request) {
+	host := strings.ToLower(req.PathValue("host"))
+	clients := t.sshClientPool.deleteHost(host)
+	for _, client := range clients {
+		_ = client.CloseWhenFinished()
+		metricSSHClientEvictionsTotal.WithLabelValues("admin").Inc()
+	}
+	log.WithFields(log.Fields{"host": host, "clients": len(clients)}).Info("reconnecting ssh connections via admin API")
+	// unlike regular requests, this ignores any backoff:
+	d, started := t.sshClientPool.startDial(host, func() (*trackingSSHClient, error) {
+		return t.connectSSHClient(host)
+	})
+	if !started {
+		metricSSHDialsDeduplicatedTotal.Inc()
+	}
+	// the result has to be written before the metrics listener's write
+	// timeout, a slower dial continues in the background:
+	timer := time.NewTimer(metricsWriteTimeout - time.Second)
+	defer timer.Stop()
+	select {
+	case <-d.done:
+	case <-timer.C:
+		writeAdminError(rw, http.StatusGatewayTimeout, fmt.Errorf("ssh connection to %s is still being established", host))
+		return
+	}
+	if d.err != nil {
+		writeAdminError(rw, http.StatusBadGateway, d.err)
+		return
+	}
+	writeAdminResponse(rw, map[string]int{"replaced": len(clients)})
+}
+
+// adminFlush removes all clients from the pool. They are closed once
+// their inflight channels have finished.
+func (t *sshTransport) adminFlush(rw http.ResponseWriter, req *http.Request) {
+	clients := t.sshClientPool.deleteAll()
+	for _, client := range clients {
+		_ = client.CloseWhenFinished()
+		metricSSHClientEvictionsTotal.WithLabelValues("admin").Inc()
+	}
+	log.WithFields(log.Fields{"clients": len(clients)}).Info("flushed ssh connection pool via admin API")
+	writeAdminResponse(rw, map[string]int{"closed": len(clients)})
+}
+
+func writeAdminResponse(rw http.ResponseWriter, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.WithFields(log.Fields{"err": err}).Debug("failed to write admin API response")
+	}
+}
+
+func writeAdminError(rw http.ResponseWriter, status int, err error) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(map[string]string{"error": err.Error()})
+}
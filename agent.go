@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgent provides signers from an ssh-agent listening on a Unix socket.
+// The agent connection is established lazily and is re-established
+// whenever a request fails, e.g. because the agent has been restarted.
+type sshAgent struct {
+	socket string
+	dial   func() (net.Conn, error)
+	mtx    sync.Mutex
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+func newSSHAgent(socket string) *sshAgent {
+	a := &sshAgent{socket: socket}
+	a.dial = func() (net.Conn, error) {
+		return net.DialTimeout("unix", socket, stepTimeoutDurationSeconds)
+	}
+	return a
+}
+
+// Signers returns the signers for all keys currently held by the agent.
+// If the existing agent connection fails, one reconnect is attempted.
+func (a *sshAgent) Signers() ([]ssh.Signer, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	var err error
+	for attempt := 1; attempt <= 2; attempt++ {
+		if a.client == nil {
+			log.WithFields(log.Fields{"socket": a.socket}).Debug("connecting to ssh-agent")
+			var conn net.Conn
+			conn, err = a.dial()
+			if err != nil {
+				continue
+			}
+			a.conn = conn
+			a.client = agent.NewClient(conn)
+		}
+		var signers []ssh.Signer
+		signers, err = a.client.Signers()
+		if err == nil {
+			return signers, nil
+		}
+		log.WithFields(log.Fields{"socket": a.socket, "err": err, "attempt": attempt}).Debug("ssh-agent request failed, reconnecting")
+		a.closeLocked()
+	}
+	return nil, fmt.Errorf("unable to query ssh-agent at %s: %s", a.socket, err)
+}
+
+// Close closes the agent connection, if any.
+func (a *sshAgent) Close() {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.closeLocked()
+}
+
+func (a *sshAgent) closeLocked() {
+	if a.conn != nil {
+		_ = a.conn.Close()
+	}
+	a.conn = nil
+	a.client = nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newTestAgent returns an sshAgent which is served by an in-process
+// keyring holding a single key. Each dial creates a new connection; the
+// server side of all connections is returned by serverConns.
+func newTestAgent(t *testing.T) (a *sshAgent, key ssh.PublicKey, serverConns func() []net.Conn) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mtx sync.Mutex
+	var conns []net.Conn
+	a = newSSHAgent("test")
+	a.dial = func() (net.Conn, error) {
+		client, server := net.Pipe()
+		mtx.Lock()
+		conns = append(conns, server)
+		mtx.Unlock()
+		go func() {
+			_ = agent.ServeAgent(keyring, server)
+		}()
+		return client, nil
+	}
+	t.Cleanup(a.Close)
+	return a, signer.PublicKey(), func() []net.Conn {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]net.Conn(nil), conns...)
+	}
+}
+
+func checkAgentSigners(t *testing.T, a *sshAgent, key ssh.PublicKey) {
+	t.Helper()
+	signers, err := a.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 {
+		t.Fatalf("got %d signers, want 1", len(signers))
+	}
+	if got, want := ssh.FingerprintSHA256(signers[0].PublicKey()), ssh.FingerprintSHA256(key); got != want {
+		t.Fatalf("got key %s, want %s", got, want)
+	}
+}
+
+func TestSSHAgentSigners(t *testing.T) {
+	a, key, serverConns := newTestAgent(t)
+	checkAgentSigners(t, a, key)
+	checkAgentSigners(t, a, key)
+	if n := len(serverConns()); n != 1 {
+		t.Fatalf("agent connection was established %d times, want 1", n)
+	}
+}
+
+func TestSSHAgentReconnect(t *testing.T) {
+	a, key, serverConns := newTestAgent(t)
+	checkAgentSigners(t, a, key)
+	// simulate an agent restart:
+	_ = serverConns()[0].Close()
+	checkAgentSigners(t, a, key)
+	if n := len(serverConns()); n != 2 {
+		t.Fatalf("agent connection was established %d times, want 2", n)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// namedSigner is a signer along with a human readable name (key file
+// or agent key fingerprint) used for logging and metrics.
+type namedSigner struct {
+	signer ssh.Signer
+	name   string
+}
+
+// authKeyRecorder remembers which key has been used for signing during
+// the authentication of a single connection. As the ssh package only
+// signs after the server has accepted a key, this is the accepted key.
+type authKeyRecorder struct {
+	mtx  sync.Mutex
+	name string
+}
+
+func (r *authKeyRecorder) record(name string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.name = name
+}
+
+// Name returns the name of the accepted key or "unknown".
+func (r *authKeyRecorder) Name() string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.name == "" {
+		return "unknown"
+	}
+	return r.name
+}
+
+// recordingSigner wraps an AlgorithmSigner and records its use.
+type recordingSigner struct {
+	ssh.AlgorithmSigner
+	onSign func()
+}
+
+func (s *recordingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	s.onSign()
+	return s.AlgorithmSigner.Sign(rand, data)
+}
+
+func (s *recordingSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	s.onSign()
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// recordingMultiAlgorithmSigner additionally preserves the list of
+// supported algorithms, which the ssh package queries via type assertion.
+type recordingMultiAlgorithmSigner struct {
+	*recordingSigner
+	algorithms []string
+}
+
+func (s *recordingMultiAlgorithmSigner) Algorithms() []string {
+	return s.algorithms
+}
+
+// wrap returns a signer which records its use in the recorder.
+// The optional signer interfaces are preserved as the ssh package
+// relies on them to negotiate signature algorithms (e.g. rsa-sha2-*).
+func (r *authKeyRecorder) wrap(ns namedSigner) ssh.Signer {
+	onSign := func() { r.record(ns.name) }
+	switch s := ns.signer.(type) {
+	case ssh.MultiAlgorithmSigner:
+		return &recordingMultiAlgorithmSigner{&recordingSigner{s, onSign}, s.Algorithms()}
+	case ssh.AlgorithmSigner:
+		return &recordingSigner{s, onSign}
+	default:
+		return s
+	}
+}
+
+// authFor builds the authentication methods for the given settings.
+// Key file and ssh-agent signers are combined into a single publickey
+// method as ssh.Client only tries the first method of each type.
+// The returned recorder provides the accepted key after the handshake.
+func (s *sshState) authFor(settings targetConfig) ([]ssh.AuthMethod, *authKeyRecorder) {
+	recorder := &authKeyRecorder{}
+	keySigners, err := keySigners(settings, s.files)
+	if err != nil {
+		// already validated in loadSSHFiles, should not happen
+		log.WithFields(log.Fields{"err": err}).Error("failed to build key signers")
+	}
+	sshAgent := s.agents[settings.AgentSocket]
+	callback := func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		for _, ns := range keySigners {
+			signers = append(signers, recorder.wrap(ns))
+		}
+		if sshAgent == nil {
+			return signers, nil
+		}
+		agentSigners, err := sshAgent.Signers()
+		if err != nil {
+			metricErrorsByType.WithLabelValues("ssh_agent").Inc()
+			log.WithFields(log.Fields{"err": err}).Warn("failed to obtain signers from ssh-agent")
+			if len(signers) == 0 {
+				return nil, err
+			}
+		}
+		for _, signer := range agentSigners {
+			name := "agent:" + ssh.FingerprintSHA256(signer.PublicKey())
+			signers = append(signers, recorder.wrap(namedSigner{signer: signer, name: name}))
+		}
+		return signers, nil
+	}
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(callback)}, recorder
+}
+
+// keySigners returns the signers for the key files of the given settings.
+// If a certificate is configured or found next to a key file, the
+// certificate signer is offered right before the plain key.
+func keySigners(settings targetConfig, files *sshFiles) ([]namedSigner, error) {
+	var signers []namedSigner
+	certUsed := settings.CertFile == ""
+	for _, keyPath := range settings.KeyFiles {
+		for _, keyFile := range files.keyFiles[keyPath] {
+			signer, ok := files.signers[keyFile]
+			if !ok {
+				continue
+			}
+			certFile := autoCertFile(keyFile)
+			if cert, ok := files.certs[settings.CertFile]; ok && certMatches(cert, signer) {
+				certFile = settings.CertFile
+				certUsed = true
+			}
+			if cert, ok := files.certs[certFile]; ok {
+				cs, err := certSigner(cert, signer)
+				if err != nil {
+					return nil, fmt.Errorf("failed to use certificate %s with key %s: %s", certFile, keyFile, err)
+				}
+				signers = append(signers, namedSigner{signer: cs, name: certFile})
+			}
+			signers = append(signers, namedSigner{signer: signer, name: keyFile})
+		}
+	}
+	if !certUsed {
+		return nil, fmt.Errorf("certificate %s does not match any of the configured keys", settings.CertFile)
+	}
+	return signers, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// backoffError is returned for requests to hosts which are in backoff
+// after failed connection attempts.
+type backoffError struct {
+	host  string
+	until time.Time
+}
+
+func (e *backoffError) Error() string {
+	return fmt.Sprintf("connecting to %s failed recently, next attempt in %s", e.host, time.Until(e.until).Round(time.Second))
+}
+
+// hostBackoffs tracks failed ssh connection attempts per host.
+// After each consecutive failure, further attempts are delayed
+// exponentially (between min and max, with jitter).
+// A successful connection resets the backoff.
+type hostBackoffs struct {
+	min, max time.Duration
+	mtx      sync.Mutex
+	hosts    map[string]*hostBackoff
+}
+
+type hostBackoff struct {
+	failures int
+	until    time.Time
+}
+
+func newHostBackoffs(min, max time.Duration) *hostBackoffs {
+	return &hostBackoffs{
+		min:   min,
+		max:   max,
+		hosts: make(map[string]*hostBackoff),
+	}
+}
+
+// check returns a *backoffError if host is currently in backoff.
+func (b *hostBackoffs) check(host string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	hb, exists := b.hosts[host]
+	if !exists || time.Now().After(hb.until) {
+		return nil
+	}
+	return &backoffError{host: host, until: hb.until}
+}
+
+// failed records a failed connection attempt.
+func (b *hostBackoffs) failed(host string) {
+	if b.min <= 0 {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	hb, exists := b.hosts[host]
+	if !exists {
+		hb = &hostBackoff{}
+		b.hosts[host] = hb
+	}
+	hb.failures++
+	delay := b.min
+	for i := 1; i < hb.failures && delay < b.max; i++ {
+		delay *= 2
+	}
+	delay = min(delay, b.max)
+	// spread retries of hosts which failed at the same time:
+	delay = delay/2 + rand.N(delay/2+1)
+	hb.until = time.Now().Add(delay)
+	log.WithFields(log.Fields{"host": host, "failures": hb.failures, "delay": delay}).Debug("backing off from host")
+}
+
+// succeeded resets the backoff for host.
+func (b *hostBackoffs) succeeded(host string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	delete(b.hosts, host)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// targetConfig holds the SSH connection settings for a target.
+// Zero values mean "not set" and are inherited from the less specific
+// level (command line flags -> config defaults -> glob targets -> exact targets).
+type targetConfig struct {
+	HostName          string        `yaml:"hostname"`
+	User              string        `yaml:"user"`
+	Port              int           `yaml:"port"`
+	KeyFiles          []string      `yaml:"key_files"`
+	KeyPassphraseFile string        `yaml:"key_passphrase_file"`
+	CertFile          string        `yaml:"cert_file"`
+	AgentSocket       string        `yaml:"agent_socket"`
+	KnownHostsFile    string        `yaml:"known_hosts_file"`
+	ConnectTimeout    time.Duration `yaml:"connect_timeout"`
+	RemoteAddrs       []string      `yaml:"remote_addrs"`
+	RemoteNetwork     string        `yaml:"remote_network"`
+	ProxyJump         string        `yaml:"proxy_jump"`
+	MaxConnections    int           `yaml:"max_connections"`
+	ScaleUpThreshold  int           `yaml:"scale_up_threshold"`
+}
+
+// targetOverride applies its settings to all hosts matching one of the
+// given hostnames or glob patterns.
+type targetOverride struct {
+	Hosts        []string `yaml:"hosts"`
+	targetConfig `yaml:",inline"`
+}
+
+type config struct {
+	Defaults targetConfig     `yaml:"defaults"`
+	Targets  []targetOverride `yaml:"targets"`
+	Forwards []portForward    `yaml:"forwards"`
+	Routes   []routeConfig    `yaml:"routes"`
+	// sshConfig is the optional OpenSSH ssh_config file.
+	sshConfig *sshConfig
+}
+
+// loadConfig reads the YAML config file and the ssh_config file at the given paths.
+// If both are empty, a config consisting only of the given defaults is returned.
+func loadConfig(filename, sshConfigFile string, defaults targetConfig) (*config, error) {
+	c := &config{}
+	if filename != "" {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config file %s: %s", filename, err)
+		}
+		if err := yaml.UnmarshalStrict(b, c); err != nil {
+			return nil, fmt.Errorf("unable to parse config file %s: %s", filename, err)
+		}
+	}
+	c.Defaults = defaults.merge(c.Defaults)
+	if sshConfigFile != "" {
+		sc, err := loadSSHConfig(sshConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		c.sshConfig = sc
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *config) validate() error {
+	// with an ssh_config file, these may be set per host only:
+	if c.sshConfig == nil {
+		if c.Defaults.User == "" {
+			return fmt.Errorf("no ssh user configured")
+		}
+		if len(c.Defaults.KeyFiles) == 0 && c.Defaults.AgentSocket == "" {
+			return fmt.Errorf("neither ssh key file nor ssh-agent socket configured")
+		}
+		if c.Defaults.KnownHostsFile == "" {
+			return fmt.Errorf("no ssh known hosts file configured")
+		}
+	}
+	if err := c.Defaults.validateRemote(); err != nil {
+		return err
+	}
+	if c.Defaults.MaxConnections < 0 || c.Defaults.ScaleUpThreshold < 0 {
+		return fmt.Errorf("max connections per host and scale up threshold must not be negative")
+	}
+	for i, t := range c.Targets {
+		if len(t.Hosts) == 0 {
+			return fmt.Errorf("target #%d: no hosts given", i+1)
+		}
+		for _, pattern := range t.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("target #%d: invalid host pattern %q", i+1, pattern)
+			}
+		}
+		if t.Port < 0 || t.Port > 65535 {
+			return fmt.Errorf("target #%d: invalid port %d", i+1, t.Port)
+		}
+		if t.MaxConnections < 0 || t.ScaleUpThreshold < 0 {
+			return fmt.Errorf("target #%d: max_connections and scale_up_threshold must not be negative", i+1)
+		}
+		if err := c.Defaults.merge(t.targetConfig).validateRemote(); err != nil {
+			return fmt.Errorf("target #%d: %s", i+1, err)
+		}
+	}
+	for _, fwd := range c.Forwards {
+		if err := fwd.validate(); err != nil {
+			return err
+		}
+	}
+	for i, r := range c.Routes {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("route #%d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+// validateRemote checks that the remote network is known and that
+// all remote addresses given as IP literals belong to it.
+func (tc targetConfig) validateRemote() error {
+	network := tc.remoteNetwork()
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("invalid remote network %q (expected tcp, tcp4 or tcp6)", network)
+	}
+	for _, addr := range tc.RemoteAddrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if (network == "tcp4" && ip.To4() == nil) || (network == "tcp6" && ip.To4() != nil) {
+			return fmt.Errorf("remote address %s does not match remote network %s", addr, network)
+		}
+	}
+	return nil
+}
+
+// remoteNetwork returns the remote network, defaulting to tcp4.
+func (tc targetConfig) remoteNetwork() string {
+	if tc.RemoteNetwork == "" {
+		return "tcp4"
+	}
+	return tc.RemoteNetwork
+}
+
+// remoteDestinations returns the addresses on the target host which
+// connections are forwarded to, in the order in which they are tried.
+// Unless set explicitly, these are the loopback addresses of the remote
+// network, preferring IPv6 if both are allowed.
+func (tc targetConfig) remoteDestinations() []string {
+	if len(tc.RemoteAddrs) > 0 {
+		return tc.RemoteAddrs
+	}
+	switch tc.remoteNetwork() {
+	case "tcp6":
+		return []string{"::1"}
+	case "tcp":
+		return []string{"::1", "127.0.0.1"}
+	}
+	return []string{"127.0.0.1"}
+}
+
+// forHost returns the effective settings for the given (lower-cased) host.
+// Settings from the ssh_config file are applied to the defaults first.
+// Glob matches are applied in file order afterwards, exact matches are
+// applied last so that they always take precedence.
+func (c *config) forHost(host string) targetConfig {
+	tc := c.Defaults
+	if c.sshConfig != nil {
+		tc = tc.merge(c.sshConfig.forHost(host))
+	}
+	for _, t := range c.Targets {
+		if t.matches(host, true) {
+			tc = tc.merge(t.targetConfig)
+		}
+	}
+	for _, t := range c.Targets {
+		if t.matches(host, false) {
+			tc = tc.merge(t.targetConfig)
+		}
+	}
+	// "none" disables an inherited jump host (like in ssh_config).
+	// A jump host itself is always connected to directly unless it has
+	// a different jump host configured:
+	tc.ProxyJump = strings.ToLower(tc.ProxyJump)
+	if tc.ProxyJump == "none" || tc.ProxyJump == host {
+		tc.ProxyJump = ""
+	}
+	return tc
+}
+
+// jumpHosts returns the chain of jump hosts which is used for reaching
+// host, starting with the one closest to host.
+func (c *config) jumpHosts(host string) ([]string, error) {
+	var chain []string
+	seen := map[string]bool{host: true}
+	for jumpHost := c.forHost(host).ProxyJump; jumpHost != ""; jumpHost = c.forHost(jumpHost).ProxyJump {
+		if seen[jumpHost] {
+			loop := append(append([]string{host}, chain...), jumpHost)
+			return nil, fmt.Errorf("jump host loop: %s", strings.Join(loop, " -> "))
+		}
+		seen[jumpHost] = true
+		chain = append(chain, jumpHost)
+	}
+	return chain, nil
+}
+
+// certFiles returns all distinct certificate files referenced by the config.
+func (c *config) certFiles() []string {
+	return c.collect(func(tc targetConfig) string { return tc.CertFile })
+}
+
+// agentSockets returns all distinct ssh-agent sockets referenced by the config.
+func (c *config) agentSockets() []string {
+	return c.collect(func(tc targetConfig) string { return tc.AgentSocket })
+}
+
+// knownHostsFiles returns all distinct known hosts files referenced by the config.
+func (c *config) knownHostsFiles() []string {
+	return c.collect(func(tc targetConfig) string { return tc.KnownHostsFile })
+}
+
+func (c *config) collect(field func(targetConfig) string) []string {
+	seen := map[string]bool{}
+	var values []string
+	for _, tc := range c.allTargetConfigs() {
+		v := field(tc)
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		values = append(values, v)
+	}
+	return values
+}
+
+// allTargetConfigs returns the defaults and the effective settings of
+// each target and ssh_config block (as if it matched on its own).
+func (c *config) allTargetConfigs() []targetConfig {
+	tcs := []targetConfig{c.Defaults}
+	if c.sshConfig != nil {
+		for _, b := range c.sshConfig.blocks {
+			tcs = append(tcs, c.Defaults.merge(b.settings))
+		}
+	}
+	for _, t := range c.Targets {
+		tcs = append(tcs, c.Defaults.merge(t.targetConfig))
+	}
+	return tcs
+}
+
+func (t targetOverride) matches(host string, glob bool) bool {
+	for _, pattern := range t.Hosts {
+		pattern = strings.ToLower(pattern)
+		isGlob := strings.ContainsAny(pattern, "*?[")
+		if isGlob != glob {
+			continue
+		}
+		if !isGlob && pattern == host {
+			return true
+		}
+		if isGlob {
+			if matched, _ := path.Match(pattern, host); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// merge returns a copy of tc with all fields which are set in o
+// replaced by their value from o.
+func (tc targetConfig) merge(o targetConfig) targetConfig {
+	if o.HostName != "" {
+		tc.HostName = o.HostName
+	}
+	if o.User != "" {
+		tc.User = o.User
+	}
+	if o.Port != 0 {
+		tc.Port = o.Port
+	}
+	if len(o.KeyFiles) > 0 {
+		tc.KeyFiles = o.KeyFiles
+	}
+	if o.KeyPassphraseFile != "" {
+		tc.KeyPassphraseFile = o.KeyPassphraseFile
+	}
+	if o.CertFile != "" {
+		tc.CertFile = o.CertFile
+	}
+	if o.AgentSocket != "" {
+		tc.AgentSocket = o.AgentSocket
+	}
+	if o.KnownHostsFile != "" {
+		tc.KnownHostsFile = o.KnownHostsFile
+	}
+	if o.ConnectTimeout != 0 {
+		tc.ConnectTimeout = o.ConnectTimeout
+	}
+	if len(o.RemoteAddrs) > 0 {
+		tc.RemoteAddrs = o.RemoteAddrs
+	}
+	if o.RemoteNetwork != "" {
+		tc.RemoteNetwork = o.RemoteNetwork
+	}
+	if o.ProxyJump != "" {
+		tc.ProxyJump = o.ProxyJump
+	}
+	if o.MaxConnections != 0 {
+		tc.MaxConnections = o.MaxConnections
+	}
+	if o.ScaleUpThreshold != 0 {
+		tc.ScaleUpThreshold = o.ScaleUpThreshold
+	}
+	return tc
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// portRange is an inclusive range of TCP ports.
+type portRange struct {
+	from, to int
+}
+
+type portRanges []portRange
+
+// parsePortRanges parses ports and port ranges such as "443" or "8000-8999".
+func parsePortRanges(specs []string) (portRanges, error) {
+	var ranges portRanges
+	for _, spec := range specs {
+		fromStr, toStr, isRange := strings.Cut(spec, "-")
+		if !isRange {
+			toStr = fromStr
+		}
+		from, err := strconv.Atoi(fromStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", spec)
+		}
+		to, err := strconv.Atoi(toStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", spec)
+		}
+		if from < 1 || to > 65535 || from > to {
+			return nil, fmt.Errorf("invalid port range %q", spec)
+		}
+		ranges = append(ranges, portRange{from: from, to: to})
+	}
+	return ranges, nil
+}
+
+func (ranges portRanges) contains(port string) bool {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		if p >= r.from && p <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// serveConnect handles HTTP CONNECT requests by hijacking the client
+// connection and splicing it to a channel on the target's SSH connection.
+func (ph *proxyHandler) serveConnect(rw http.ResponseWriter, req *http.Request) error {
+	metricRequestsTotal.Inc()
+	_, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		metricRequestsFailedTotal.Inc()
+		metricErrorsByType.WithLabelValues("address_parsing").Inc()
+		http.Error(rw, "invalid CONNECT address", http.StatusBadRequest)
+		return errors.New("failed to parse CONNECT address")
+	}
+	if !connectAllowedPorts.contains(port) {
+		metricRequestsFailedTotal.Inc()
+		metricErrorsByType.WithLabelValues("connect_port_denied").Inc()
+		http.Error(rw, "CONNECT to this port is not allowed", http.StatusForbidden)
+		return fmt.Errorf("CONNECT to port %s is not allowed", port)
+	}
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		metricRequestsFailedTotal.Inc()
+		http.Error(rw, "CONNECT is not supported", http.StatusInternalServerError)
+		return errors.New("connection cannot be hijacked")
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeoutDurationSeconds)
+	upstream, err := ph.ssh.dialTunnel(ctx, req.Host)
+	cancel()
+	if err != nil {
+		metricRequestsFailedTotal.Inc()
+		metricErrorsByType.WithLabelValues("upstream_request").Inc()
+		log.WithFields(log.Fields{"err": err}).Debug("upstream tunnel failed")
+		var backoffErr *backoffError
+		if errors.As(err, &backoffErr) {
+			http.Error(rw, "ssh connection to target host failed recently, not retrying yet", http.StatusBadGateway)
+		} else {
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+		return errors.New("upstream tunnel failed")
+	}
+	defer func() { _ = upstream.Close() }()
+	client, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		metricRequestsFailedTotal.Inc()
+		return fmt.Errorf("failed to hijack connection: %s", err)
+	}
+	defer func() { _ = client.Close() }()
+	// the http server's deadlines are still in place after hijacking:
+	_ = client.SetDeadline(time.Time{})
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		metricRequestsFailedTotal.Inc()
+		return fmt.Errorf("failed to confirm tunnel: %s", err)
+	}
+	log.WithFields(log.Fields{"addr": req.Host}).Trace("tunnel established")
+	// bytes which the client sent along with the CONNECT request
+	// are still in the server's buffer:
+	var clientReader io.Reader = client
+	if clientBuf.Reader.Buffered() > 0 {
+		clientReader = clientBuf.Reader
+	}
+	spliceConns(client, clientReader, upstream, timeoutDurationSeconds)
+	return nil
+}
+
+// spliceConns copies data between client and upstream in both directions
+// until either side closes its connection or the tunnel stays idle for
+// longer than idleTimeout (0 = no idle timeout).
+// SSH channels do not support deadlines, so a shared idle timer is used.
+func spliceConns(client net.Conn, clientReader io.Reader, upstream net.Conn, idleTimeout time.Duration) {
+	closeBoth := func() {
+		_ = client.Close()
+		_ = upstream.Close()
+	}
+	resetIdleTimer := func() {}
+	if idleTimeout > 0 {
+		idleTimer := time.AfterFunc(idleTimeout, func() {
+			log.Trace("closing idle tunnel")
+			closeBoth()
+		})
+		defer idleTimer.Stop()
+		resetIdleTimer = func() { idleTimer.Reset(idleTimeout) }
+	}
+	var wg sync.WaitGroup
+	pipe := func(dst io.Writer, src io.Reader, direction string) {
+		defer wg.Done()
+		// unblock the opposite direction once we are done:
+		defer closeBoth()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				resetIdleTimer()
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return
+				}
+				metricTunnelBytes.WithLabelValues(direction).Add(float64(n))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go pipe(upstream, clientReader, "upstream")
+	go pipe(client, upstream, "downstream")
+	wg.Wait()
+}
+
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader
+// which may already hold data read from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connectViaProxy asks the HTTP proxy at the other end of conn to
+// establish a tunnel to addr.
+func connectViaProxy(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	// SSH channels do not support deadlines, therefore we abort
+	// by closing the connection:
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to send CONNECT request to next proxy: %s", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONNECT response from next proxy: %s", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("next proxy refused CONNECT: %s", resp.Status)
+	}
+	return bufferedConn{Conn: conn, r: br}, nil
+}
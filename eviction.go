@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// evictExpiredClients periodically removes pooled ssh clients which
+// have been idle for longer than idleTimeout or which are older than
+// maxAge (0 = no limit).
+// Evicted clients are closed using CloseWhenFinished, so inflight
+// channels are not affected.
+func (t *sshTransport) evictExpiredClients(idleTimeout, maxAge time.Duration) {
+	interval := time.Minute
+	for _, d := range []time.Duration{idleTimeout, maxAge} {
+		if d > 0 && d/4 < interval {
+			interval = max(d/4, time.Second)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.evictClients(idleTimeout, maxAge)
+	}
+}
+
+func (t *sshTransport) evictClients(idleTimeout, maxAge time.Duration) {
+	for host, clients := range t.sshClientPool.all() {
+		for _, client := range clients {
+			reason := ""
+			if idleSince := client.idleSince(); idleTimeout > 0 && !idleSince.IsZero() && time.Since(idleSince) > idleTimeout {
+				reason = "idle"
+			} else if maxAge > 0 && time.Since(client.createdAt) > maxAge {
+				reason = "max_age"
+			}
+			if reason == "" {
+				continue
+			}
+			log.WithFields(log.Fields{"host": host, "reason": reason}).Debug("evicting ssh connection")
+			t.sshClientPool.delete(host, client)
+			_ = client.CloseWhenFinished()
+			metricSSHClientEvictionsTotal.WithLabelValues(reason).Inc()
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// portForward describes a static local port forwarding similar to
+// ssh -L: connections accepted on Listen are forwarded to Target
+// (host:port, as seen from the target host) via sshTransport.
+type portForward struct {
+	Listen string `yaml:"listen"`
+	Target string `yaml:"target"`
+}
+
+// parsePortForward parses a forwarding given as LISTEN=TARGET,
+// e.g. 127.0.0.1:15432=db1.example.org:5432.
+func parsePortForward(spec string) (portForward, error) {
+	listen, target, ok := strings.Cut(spec, "=")
+	if !ok {
+		return portForward{}, fmt.Errorf("invalid forwarding %q, expected LISTEN=TARGET", spec)
+	}
+	fwd := portForward{Listen: listen, Target: target}
+	return fwd, fwd.validate()
+}
+
+func (fwd portForward) validate() error {
+	if _, _, err := net.SplitHostPort(fwd.Listen); err != nil {
+		return fmt.Errorf("invalid forwarding listen address %q: %s", fwd.Listen, err)
+	}
+	if _, _, err := net.SplitHostPort(fwd.Target); err != nil {
+		return fmt.Errorf("invalid forwarding target address %q: %s", fwd.Target, err)
+	}
+	return nil
+}
+
+func (fwd portForward) String() string {
+	return fwd.Listen + "->" + fwd.Target
+}
+
+// servePortForward accepts connections on l and forwards each of them
+// to the forwarding target.
+func servePortForward(ssh *sshTransport, fwd portForward, l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := forwardConn(ssh, fwd, conn)
+			if err != nil {
+				log.WithFields(log.Fields{"forward": fwd, "remote": conn.RemoteAddr(), "err": err}).Debug("forwarding failed")
+			}
+		}()
+	}
+}
+
+func forwardConn(ssh *sshTransport, fwd portForward, conn net.Conn) error {
+	defer func() { _ = conn.Close() }()
+	metricForwardConnectionsTotal.WithLabelValues(fwd.String()).Inc()
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutDurationSeconds)
+	upstream, err := ssh.dialTunnel(ctx, fwd.Target)
+	cancel()
+	if err != nil {
+		metricErrorsByType.WithLabelValues("forward").Inc()
+		return fmt.Errorf("upstream tunnel failed: %s", err)
+	}
+	defer func() { _ = upstream.Close() }()
+	log.WithFields(log.Fields{"forward": fwd}).Trace("forwarding established")
+	// like with SOCKS, long-lived idle connections are expected here:
+	spliceConns(conn, conn, upstream, 0)
+	return nil
+}
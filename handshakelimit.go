@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errHandshakeQueueTimeout is returned if a handshake could not be
+// started in time due to the limits. It does not indicate a problem
+// with the host itself.
+var errHandshakeQueueTimeout = errors.New("timed out waiting in handshake queue")
+
+// handshakeLimiter limits the number of concurrent ssh handshakes and,
+// optionally, the rate at which new handshakes are started.
+// This avoids overloading sshified itself (key exchange) and the ssh
+// servers (MaxStartups) when connecting to many hosts at once.
+type handshakeLimiter struct {
+	slots    chan struct{}
+	interval time.Duration
+	mtx      sync.Mutex
+	next     time.Time
+}
+
+// newHandshakeLimiter returns a limiter for at most maxConcurrent
+// handshakes (0 = unlimited) and at most ratePerSecond new handshakes
+// per second (0 = unlimited).
+func newHandshakeLimiter(maxConcurrent int, ratePerSecond float64) *handshakeLimiter {
+	l := &handshakeLimiter{}
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	if ratePerSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / ratePerSecond)
+	}
+	return l
+}
+
+// acquire waits until a handshake may be started and returns a function
+// which has to be called once the handshake has finished.
+func (l *handshakeLimiter) acquire(ctx context.Context) (func(), error) {
+	metricSSHHandshakeQueueDepth.Inc()
+	start := time.Now()
+	defer func() {
+		metricSSHHandshakeQueueDepth.Dec()
+		metricSSHHandshakeQueueWait.Observe(time.Since(start).Seconds())
+	}()
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (concurrency limit): %s", errHandshakeQueueTimeout, context.Cause(ctx))
+		}
+	}
+	release := func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+	if err := l.waitForRate(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// waitForRate spaces handshakes evenly according to the configured rate.
+func (l *handshakeLimiter) waitForRate(ctx context.Context) error {
+	if l.interval == 0 {
+		return nil
+	}
+	l.mtx.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	l.mtx.Unlock()
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w (rate limit): %s", errHandshakeQueueTimeout, context.Cause(ctx))
+	}
+}
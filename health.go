@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// proxyListening is set once the proxy listener has been bound.
+	proxyListening atomic.Bool
+	// draining is set while shutting down gracefully.
+	draining atomic.Bool
+)
+
+// registerHealthEndpoints adds /-/healthy, which succeeds as long as the
+// process is serving, and /-/ready, which only succeeds if requests can be
+// handled (see ready).
+func (t *sshTransport) registerHealthEndpoints(mux *http.ServeMux) {
+	mux.HandleFunc("GET /-/healthy", func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(rw, "sshified is Healthy.")
+	})
+	mux.HandleFunc("GET /-/ready", func(rw http.ResponseWriter, req *http.Request) {
+		if err := t.ready(req.Context()); err != nil {
+			log.WithFields(log.Fields{"err": err}).Debug("readiness check failed")
+			http.Error(rw, fmt.Sprintf("sshified is not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(rw, "sshified is Ready.")
+	})
+}
+
+// ready reports whether sshified is ready to handle requests: the keys and
+// known hosts have been loaded, the proxy listener is bound, no shutdown is
+// in progress and, if configured, the canary host can be reached via ssh.
+func (t *sshTransport) ready(ctx context.Context) error {
+	if draining.Load() {
+		return errors.New("shutting down")
+	}
+	if !proxyListening.Load() {
+		return errors.New("proxy listener not bound yet")
+	}
+	if state := t.state.Load(); state == nil || state.files == nil {
+		return errors.New("keys and known hosts not loaded")
+	}
+	if *readyCanaryHost == "" {
+		return nil
+	}
+	// the result has to be written before the metrics listener's write
+	// timeout, otherwise the client only sees a dropped connection:
+	ctx, cancel := context.WithTimeout(ctx, min(stepTimeoutDurationSeconds, metricsWriteTimeout-time.Second))
+	defer cancel()
+	if err := t.checkHost(ctx, *readyCanaryHost); err != nil {
+		return fmt.Errorf("canary host %s not reachable: %s", *readyCanaryHost, err)
+	}
+	return nil
+}
+
+// checkHost ensures that there is a working ssh connection to host.
+func (t *sshTransport) checkHost(ctx context.Context, host string) error {
+	result := make(chan error, 1)
+	go func() {
+		client, err := t.getSSHClient(host)
+		if err == nil {
+			err = client.CheckKeepalive(ctx)
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// probeIdleClients periodically sends keepalives on all pooled ssh
+// clients which are currently idle. This detects dead connections
+// before a request is routed to them.
+// Busy clients are skipped, failing channels already trigger a keepalive
+// check for them.
+func (t *sshTransport) probeIdleClients(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.probeClients()
+	}
+}
+
+// probeClients sends a keepalive on each idle pooled client in parallel
+// and waits for all of them.
+func (t *sshTransport) probeClients() {
+	wg := sync.WaitGroup{}
+	for host, clients := range t.sshClientPool.all() {
+		for _, client := range clients {
+			if client.idleSince().IsZero() {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.probeClient(host, client)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func (t *sshTransport) probeClient(host string, client *trackingSSHClient) {
+	start := time.Now()
+	err := client.CheckKeepalive(context.Background())
+	if err == nil {
+		metricSSHKeepaliveRTT.WithLabelValues(host).Observe(time.Since(start).Seconds())
+		return
+	}
+	log.WithFields(log.Fields{"host": host, "err": err}).Info("background keepalive failed, dropping ssh connection")
+	t.evictDeadClient(host, client)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// keyPassphraseEnvVar names the environment variable which can hold the
+// passphrase for encrypted private keys. A passphrase file takes precedence.
+const keyPassphraseEnvVar = "SSHIFIED_SSH_KEY_PASSPHRASE"
+
+// loadPrivateKey reads and parses the given private key file.
+// Encrypted keys are decrypted using the passphrase from passphraseFile
+// or from the environment.
+// The passphrase must never end up in errors or logs.
+func loadPrivateKey(keyFile, passphraseFile string) (ssh.Signer, error) {
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key file %s", keyFile)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	var passphraseMissingError *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseMissingError) {
+		passphrase, err := readKeyPassphrase(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("private key file %s is encrypted, but no passphrase has been configured", keyFile)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt private key file %s (wrong passphrase?)", keyFile)
+		}
+		return signer, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key file %s", keyFile)
+	}
+	return signer, nil
+}
+
+// readKeyPassphrase returns the passphrase from the given file (without
+// trailing newline) or, if no file is given, from the environment.
+func readKeyPassphrase(passphraseFile string) ([]byte, error) {
+	if passphraseFile == "" {
+		return []byte(os.Getenv(keyPassphraseEnvVar)), nil
+	}
+	b, err := os.ReadFile(passphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key passphrase file %s", passphraseFile)
+	}
+	return bytes.TrimRight(b, "\r\n"), nil
+}
+
+// expandKeyPath returns the key files for the given path. Directories
+// are expanded to all contained regular files, except for hidden files
+// and public key or certificate (*.pub) files. Symlinks are followed, as
+// e.g. Kubernetes mounts secrets as symlinks into a hidden directory.
+func expandKeyPath(keyPath string) ([]string, error) {
+	fi, err := os.Stat(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key file %s", keyPath)
+	}
+	if !fi.IsDir() {
+		return []string{keyPath}, nil
+	}
+	entries, err := os.ReadDir(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key directory %s", keyPath)
+	}
+	var keyFiles []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || strings.HasSuffix(e.Name(), ".pub") {
+			continue
+		}
+		keyFile := filepath.Join(keyPath, e.Name())
+		fi, err := os.Stat(keyFile)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		keyFiles = append(keyFiles, keyFile)
+	}
+	if len(keyFiles) == 0 {
+		return nil, fmt.Errorf("private key directory %s does not contain any keys", keyPath)
+	}
+	return keyFiles, nil
+}
+
+// autoCertFile returns the name of the certificate file which OpenSSH
+// would pick up automatically for the given key file.
+func autoCertFile(keyFile string) string {
+	return keyFile + "-cert.pub"
+}
+
+func loadCertificate(certFile string) (*ssh.Certificate, error) {
+	b, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate file %s", certFile)
+	}
+	pubkey, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificate file %s", certFile)
+	}
+	cert, ok := pubkey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("file %s does not contain a certificate", certFile)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate %s is not a user certificate", certFile)
+	}
+	remaining := certRemainingValidity(cert)
+	fields := log.Fields{"file": certFile, "keyId": cert.KeyId, "principals": cert.ValidPrincipals, "remaining": remaining}
+	if remaining <= 0 {
+		log.WithFields(fields).Warn("loaded expired ssh certificate")
+	} else {
+		log.WithFields(fields).Info("loaded ssh certificate")
+	}
+	return cert, nil
+}
+
+// certMatches checks whether the certificate has been issued for the signer's key.
+func certMatches(cert *ssh.Certificate, signer ssh.Signer) bool {
+	return bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal())
+}
+
+// certSigner wraps signer with the given certificate.
+func certSigner(cert *ssh.Certificate, signer ssh.Signer) (ssh.Signer, error) {
+	if !certMatches(cert, signer) {
+		return nil, errors.New("certificate does not match private key")
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// certRemainingValidity returns the time until the certificate expires.
+// Certificates without expiry return the maximum duration.
+func certRemainingValidity(cert *ssh.Certificate) time.Duration {
+	if cert.ValidBefore > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Until(time.Unix(int64(cert.ValidBefore), 0))
+}
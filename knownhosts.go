@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// certHostKeyAlgos lists the host certificate algorithms we advertise
+// when a @cert-authority entry matches a host. The type of the host key
+// itself is unknown in this case, so all supported types are offered.
+var certHostKeyAlgos = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoSKED25519v01,
+	ssh.CertAlgoSKECDSA256v01,
+	ssh.CertAlgoRSASHA512v01,
+	ssh.CertAlgoRSASHA256v01,
+}
+
+// knownHostsLine identifies a single line in a known hosts file.
+type knownHostsLine struct {
+	file string
+	line int
+}
+
+// knownHosts wraps the knownhosts callback and additionally remembers
+// which lines are @cert-authority entries. The knownhosts package
+// reports those lines like plain host keys when looking up a host.
+type knownHosts struct {
+	callback           ssh.HostKeyCallback
+	certAuthorityLines map[knownHostsLine]bool
+}
+
+func loadKnownHosts(file string) (*knownHosts, error) {
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	kh := &knownHosts{
+		callback:           callback,
+		certAuthorityLines: make(map[knownHostsLine]bool),
+	}
+	// line numbering has to match the one of the knownhosts package:
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		fields := bytes.Fields(scanner.Bytes())
+		if len(fields) > 0 && string(fields[0]) == "@cert-authority" {
+			kh.certAuthorityLines[knownHostsLine{file: file, line: lineNum}] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", file, err)
+	}
+	return kh, nil
+}
+
+func (kh *knownHosts) isCertAuthority(k knownhosts.KnownKey) bool {
+	return kh.certAuthorityLines[knownHostsLine{file: k.Filename, line: k.Line}]
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -15,17 +18,45 @@ var (
 	verbose                     = kingpin.Flag("verbose", "Verbose mode.").Short('v').Bool()
 	trace                       = kingpin.Flag("trace", "Trace mode.").Bool()
 	proxyAddr                   = kingpin.Flag("proxy.listen-addr", "address the proxy will listen on").Required().String()
-	nextProxyAddr               = kingpin.Flag("next-proxy.addr", "optional address of another http proxy when cascading usage is required").String()
+	nextProxyAddrs              = kingpin.Flag("next-proxy.addr", "optional address of another http proxy when cascading usage is required, can be repeated for failover (targets matching a route in --config.file use that route's next proxies instead)").Strings()
+	socksAddr                   = kingpin.Flag("socks.listen-addr", "optional address for accepting SOCKS5 connections").String()
+	forwardSpecs                = kingpin.Flag("forward", "static port forwarding LISTEN=TARGET (e.g. 127.0.0.1:15432=db1.example.org:5432), can be repeated").Strings()
 	metricsAddr                 = kingpin.Flag("metrics.listen-addr", "adress the service will listen on for metrics request about itself").String()
-	sshUser                     = kingpin.Flag("ssh.user", "username used for connecting via ssh").Required().String()
-	sshKeyFile                  = kingpin.Flag("ssh.key-file", "private key file used for connecting via ssh").Required().String()
-	sshKnownHostsFile           = kingpin.Flag("ssh.known-hosts-file", "known hosts file used for connecting via ssh").Required().String()
+	readyCanaryHost             = kingpin.Flag("ready.canary-host", "optional host which has to be reachable via ssh for /-/ready to succeed").String()
+	adminAPI                    = kingpin.Flag("metrics.admin-api", "serve the admin API for inspecting and managing the ssh connection pool on --metrics.listen-addr").Bool()
+	configFile                  = kingpin.Flag("config.file", "optional YAML config file with ssh defaults and per-target overrides").String()
+	sshConfigFile               = kingpin.Flag("ssh.config-file", "optional OpenSSH ssh_config file with per-host settings (HostName, User, Port, IdentityFile, UserKnownHostsFile, ProxyJump)").String()
+	sshUser                     = kingpin.Flag("ssh.user", "username used for connecting via ssh (required unless set in --config.file)").String()
+	sshKeyFiles                 = kingpin.Flag("ssh.key-file", "private key file or directory of key files used for connecting via ssh, can be repeated (required unless set in --config.file or using an ssh-agent)").Strings()
+	sshKeyPassphraseFile        = kingpin.Flag("ssh.key-passphrase-file", "optional file containing the passphrase for encrypted --ssh.key-file keys (alternatively, set "+keyPassphraseEnvVar+")").String()
+	sshCertFile                 = kingpin.Flag("ssh.cert-file", "optional certificate file for one of the --ssh.key-file keys (default: <key-file>-cert.pub if it exists)").String()
+	sshAgentSocket              = kingpin.Flag("ssh.agent-socket", "ssh-agent unix socket used for connecting via ssh (set to an empty string to disable)").Envar("SSH_AUTH_SOCK").String()
+	sshKnownHostsFile           = kingpin.Flag("ssh.known-hosts-file", "known hosts file used for connecting via ssh (required unless set in --config.file)").String()
 	sshPort                     = kingpin.Flag("ssh.port", "port used for connecting via ssh").Default("22").Int()
+	sshProxyJump                = kingpin.Flag("ssh.proxy-jump", "optional jump host (bastion) used for reaching the targets; its ssh settings are looked up like for any other target").String()
+	sshBackoffMin               = kingpin.Flag("ssh.backoff-min", "time for which requests to a host fail fast after a failed ssh connection attempt, doubled for each consecutive failure (0 = disabled)").Default("1s").Duration()
+	sshBackoffMax               = kingpin.Flag("ssh.backoff-max", "maximum time for which requests to a host fail fast after failed ssh connection attempts").Default("1m").Duration()
+	sshMaxConcurrentHandshakes  = kingpin.Flag("ssh.max-concurrent-handshakes", "maximum number of concurrent ssh handshakes (0 = unlimited)").Default("100").Int()
+	sshHandshakeRate            = kingpin.Flag("ssh.handshake-rate", "maximum number of new ssh handshakes per second (0 = unlimited)").Default("0").Float64()
+	sshMaxConnections           = kingpin.Flag("ssh.max-connections-per-host", "maximum number of ssh connections per host").Default("1").Int()
+	sshScaleUpThreshold         = kingpin.Flag("ssh.scale-up-threshold", "number of inflight channels on the least loaded ssh connection of a host at which another connection is established (up to --ssh.max-connections-per-host)").Default("10").Int()
+	sshIdleTimeout              = kingpin.Flag("ssh.idle-timeout", "close ssh connections which have not been used for this long (0 = never)").Default("1h").Duration()
+	sshMaxAge                   = kingpin.Flag("ssh.max-age", "replace ssh connections after this long, once they are no longer in use (0 = never)").Default("0").Duration()
+	sshKeepaliveInterval        = kingpin.Flag("ssh.keepalive-interval", "send keepalives on idle ssh connections at this interval to detect dead ones early (0 = disabled)").Default("30s").Duration()
+	sshRemoteAddrs              = kingpin.Flag("ssh.remote-addr", "address on the target host which requests are forwarded to, can be repeated to try several addresses in order (default: loopback address of --ssh.remote-network)").Strings()
+	sshRemoteNetwork            = kingpin.Flag("ssh.remote-network", "network used on the target host: tcp4, tcp6 or tcp (IPv6 with IPv4 fallback)").Default("tcp4").Enum("tcp", "tcp4", "tcp6")
+	reloadWatchFiles            = kingpin.Flag("reload.watch-files", "reload automatically when key, certificate or known hosts files change (like on SIGHUP)").Bool()
+	reloadPollInterval          = kingpin.Flag("reload.poll-interval", "interval for checking the watched files if inotify is not available").Default("30s").Duration()
+	shutdownGracePeriod         = kingpin.Flag("shutdown.grace-period", "time to wait for inflight requests and tunnels on SIGTERM/SIGINT before exiting").Default("60s").Duration()
 	timeout                     = kingpin.Flag("timeout", "full roundtrip request timeout in seconds").Default("50").Int()
 	timeoutDurationSeconds      time.Duration
 	stepTimeoutDurationSeconds  time.Duration
 	responseMaxBytes            = kingpin.Flag("response.max-bytes", "maximum length of upstream response in bytes (0 = no limit)").Default("0").Int64()
 	responseRejectNonPrometheus = kingpin.Flag("response.reject-non-prometheus", "parse upstream response as Prometheus metrics and reject unparsable responses").Bool()
+	connectAllowedPortSpecs     = kingpin.Flag("connect.allowed-port", "port or port range (e.g. 8000-8999) which may be tunneled using CONNECT, can be repeated").Default("443").Strings()
+	connectAllowedPorts         portRanges
+	unixSocketAllowedPathSpecs  = kingpin.Flag("unix-socket.allowed-path", "remote unix socket path or glob pattern (e.g. /run/php/*.sock) which may be accessed using "+unixSocketParam+", can be repeated").Strings()
+	unixSocketAllowedPaths      unixSocketPatterns
 )
 
 func main() {
@@ -45,17 +76,33 @@ func main() {
 	if *responseMaxBytes <= 0 && *responseRejectNonPrometheus {
 		kingpin.Fatalf("setting --response.reject-non-prometheus also requires setting a --response.max-bytes value due to internal buffering needs")
 	}
+	var err error
+	connectAllowedPorts, err = parsePortRanges(*connectAllowedPortSpecs)
+	if err != nil {
+		kingpin.Fatalf("invalid --connect.allowed-port: %s", err)
+	}
+	unixSocketAllowedPaths, err = parseUnixSocketPatterns(*unixSocketAllowedPathSpecs)
+	if err != nil {
+		kingpin.Fatalf("invalid --unix-socket.allowed-path: %s", err)
+	}
 	log.WithFields(log.Fields{"addr": *proxyAddr}).Info("Listening")
-	if *nextProxyAddr != "" {
-		log.WithFields(log.Fields{"nextProxyAddr": *nextProxyAddr}).Info("Running in cascading mode: will ssh to nextProxyAddr and use the http proxy there")
+	if len(*nextProxyAddrs) > 0 {
+		log.WithFields(log.Fields{"nextProxyAddrs": *nextProxyAddrs}).Info("Running in cascading mode: will ssh to nextProxyAddr and use the http proxy there")
+		if err := validateNextProxies(*nextProxyAddrs); err != nil {
+			kingpin.Fatalf("invalid --next-proxy.addr: %s", err)
+		}
+	}
+	config, err := loadConfigFromFlags()
+	if err != nil {
+		kingpin.Fatalf("invalid configuration: %s", err)
 	}
-	sshTransport, err := NewSSHTransport(*sshUser, *sshKeyFile, *sshKnownHostsFile, *sshPort, *nextProxyAddr)
+	sshTransport, err := NewSSHTransport(config, *nextProxyAddrs)
 	if err != nil {
 		log.WithFields(log.Fields{"err": err}).Fatal("failed to set up ssh config")
 	}
-	// only enable HTTPS support at the last sshified instance in a cascading setup:
-	enableHTTPS := *nextProxyAddr == ""
-	ph := NewProxyHandler(sshTransport, enableHTTPS)
+	metricConfigLastReloadSuccessful.Set(1)
+	metricConfigLastReloadSuccessTimestamp.Set(float64(time.Now().Unix()))
+	ph := NewProxyHandler(sshTransport)
 	s := &http.Server{
 		Addr:           *proxyAddr,
 		Handler:        ph,
@@ -64,20 +111,103 @@ func main() {
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	setupMetrics(*metricsAddr)
+	setupMetrics(*metricsAddr, sshTransport)
+	// listeners which are closed on shutdown in addition to the proxy:
+	var listeners []net.Listener
+	for _, fwd := range config.Forwards {
+		l, err := net.Listen("tcp", fwd.Listen)
+		if err != nil {
+			log.WithFields(log.Fields{"forward": fwd, "err": err}).Fatal("failed to listen for port forwarding")
+		}
+		listeners = append(listeners, l)
+		log.WithFields(log.Fields{"forward": fwd}).Info("Forwarding port")
+		go func() {
+			if err := servePortForward(sshTransport, fwd, l); !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if *socksAddr != "" {
+		l, err := net.Listen("tcp", *socksAddr)
+		if err != nil {
+			log.WithFields(log.Fields{"addr": *socksAddr, "err": err}).Fatal("failed to listen for SOCKS5 connections")
+		}
+		listeners = append(listeners, l)
+		log.WithFields(log.Fields{"addr": *socksAddr}).Info("Listening for SOCKS5 connections")
+		socks := NewSOCKSServer(sshTransport)
+		go func() {
+			if err := socks.Serve(l); !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
 
 	go func() {
 		for range c {
-			log.Info("got SIGHUP, reloading known hosts and key file")
-			err := sshTransport.LoadFiles()
-			if err == nil {
-				log.Info("successfully reloaded")
-			} else {
-				log.WithFields(log.Fields{"err": err}).Error("reload failed")
-			}
+			log.Info("got SIGHUP, reloading configuration")
+			_ = reloadConfig(sshTransport)
 		}
 	}()
-	log.Fatal(s.ListenAndServe())
+	if *reloadWatchFiles {
+		go watchFiles(sshTransport.watchedFiles, func() {
+			_ = reloadConfig(sshTransport)
+		}, *reloadPollInterval)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	drained := make(chan struct{})
+	go func() {
+		sig := <-stop
+		// a second signal terminates immediately:
+		signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+		log.WithFields(log.Fields{"signal": sig, "gracePeriod": *shutdownGracePeriod}).Info("shutting down gracefully")
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+		drain(s, sshTransport, *shutdownGracePeriod)
+		close(drained)
+	}()
+	l, err := net.Listen("tcp", *proxyAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxyListening.Store(true)
+	if err := s.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-drained
+	log.Info("shutdown complete")
+}
+
+// loadConfigFromFlags loads the config files given on the command line
+// with the command line flags as defaults.
+func loadConfigFromFlags() (*config, error) {
+	config, err := loadConfig(*configFile, *sshConfigFile, targetConfig{
+		User:              *sshUser,
+		Port:              *sshPort,
+		KeyFiles:          *sshKeyFiles,
+		KeyPassphraseFile: *sshKeyPassphraseFile,
+		CertFile:          *sshCertFile,
+		AgentSocket:       *sshAgentSocket,
+		KnownHostsFile:    *sshKnownHostsFile,
+		ConnectTimeout:    stepTimeoutDurationSeconds,
+		RemoteAddrs:       *sshRemoteAddrs,
+		RemoteNetwork:     *sshRemoteNetwork,
+		ProxyJump:         *sshProxyJump,
+		MaxConnections:    *sshMaxConnections,
+		ScaleUpThreshold:  *sshScaleUpThreshold,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range *forwardSpecs {
+		fwd, err := parsePortForward(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --forward: %s", err)
+		}
+		config.Forwards = append(config.Forwards, fwd)
+	}
+	return config, nil
 }
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"math"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -16,6 +19,27 @@ var (
 			Help: "Total of all payload data transferred",
 		},
 	)
+	metricTunnelBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sshified_tunnel_bytes_total",
+			Help: "Total of all data transferred through tunnels (CONNECT) by direction",
+		},
+		[]string{"direction"},
+	)
+	metricForwardConnectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sshified_forward_connections_total",
+			Help: "Total of all connections accepted by static port forwardings",
+		},
+		[]string{"forward"},
+	)
+	metricNextProxyHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sshified_next_proxy_healthy",
+			Help: "Whether the last connection attempt to the next proxy succeeded",
+		},
+		[]string{"next_proxy"},
+	)
 	metricErrorsByType = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "sshified_connection_errors_total",
@@ -29,12 +53,46 @@ var (
 			Help: "Number of cached ssh connections",
 		},
 	)
+	metricSSHDialsDeduplicatedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sshified_ssh_dials_deduplicated_total",
+			Help: "Total of requests which waited for an inflight ssh connection attempt instead of starting their own",
+		},
+	)
+	metricSSHHandshakeQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sshified_ssh_handshake_queue_depth",
+			Help: "Number of ssh connection attempts waiting for a handshake slot",
+		},
+	)
+	metricSSHHandshakeQueueWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "sshified_ssh_handshake_queue_wait_seconds",
+			Help:    "Histogram of the time ssh connection attempts waited for a handshake slot",
+			Buckets: []float64{0.001, 0.01, 0.1, 0.5, 1.0, 5.0, 10.0, 30.0},
+		},
+	)
+	metricSSHClientEvictionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sshified_ssh_client_evictions_total",
+			Help: "Total of all ssh connections removed from the pool by reason",
+		},
+		[]string{"reason"},
+	)
 	metricSSHKeepaliveFailuresTotal = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "sshified_ssh_keepalive_failures_total",
 			Help: "Total of all SSH keepalive failures (aborts, reconnects)",
 		},
 	)
+	metricSSHKeepaliveRTT = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sshified_ssh_keepalive_rtt_seconds",
+			Help:    "Round-trip time of background SSH keepalives by host",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1.0, 5.0},
+		},
+		[]string{"host"},
+	)
 	metricRequestDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "sshified_request_duration_seconds",
@@ -42,6 +100,37 @@ var (
 			Buckets: []float64{0.01, 0.1, 0.5, 1.0, 2.0, 5.0},
 		},
 	)
+	metricRequestsInflight = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "sshified_requests_inflight",
+			Help: "Number of proxy requests currently being handled",
+		},
+		func() float64 { return float64(requestsInflight.Load()) },
+	)
+	metricShutdownDraining = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sshified_shutdown_draining",
+			Help: "Whether a graceful shutdown is in progress (1) or not (0)",
+		},
+	)
+	metricShutdownRemainingChannels = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sshified_shutdown_remaining_ssh_channels",
+			Help: "Number of ssh channels still open during a graceful shutdown",
+		},
+	)
+	metricConfigLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sshified_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful",
+		},
+	)
+	metricConfigLastReloadSuccessTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sshified_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload",
+		},
+	)
 	metricRequestsTotal = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "sshified_requests_total",
@@ -54,28 +143,99 @@ var (
 			Help: "Total of failed requests",
 		},
 	)
+	metricSSHAuthKeyAcceptedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sshified_ssh_auth_key_accepted_total",
+			Help: "Total of successful SSH authentications by the key which has been accepted",
+		},
+		[]string{"key"},
+	)
+	metricSSHCertificateValidity = &certValidityCollector{
+		desc: prometheus.NewDesc(
+			"sshified_ssh_certificate_remaining_validity_seconds",
+			"Remaining validity of the loaded SSH user certificates (+Inf for certificates without expiry)",
+			[]string{"file"}, nil,
+		),
+	}
 )
 
+// certValidityCollector exports the remaining validity of the currently
+// loaded certificates. It is computed on each scrape as it changes
+// continuously.
+type certValidityCollector struct {
+	desc  *prometheus.Desc
+	mtx   sync.Mutex
+	certs map[string]*ssh.Certificate
+}
+
+func (c *certValidityCollector) Set(certs map[string]*ssh.Certificate) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.certs = certs
+}
+
+func (c *certValidityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *certValidityCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for file, cert := range c.certs {
+		remaining := certRemainingValidity(cert).Seconds()
+		if cert.ValidBefore == ssh.CertTimeInfinity {
+			remaining = math.Inf(1)
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, remaining, file)
+	}
+}
+
 func init() {
 	prometheus.MustRegister(metricPayloadBytes)
+	prometheus.MustRegister(metricTunnelBytes)
+	prometheus.MustRegister(metricForwardConnectionsTotal)
+	prometheus.MustRegister(metricNextProxyHealthy)
 	prometheus.MustRegister(metricSshclientPool)
 	prometheus.MustRegister(metricSSHKeepaliveFailuresTotal)
+	prometheus.MustRegister(metricSSHKeepaliveRTT)
+	prometheus.MustRegister(metricSSHDialsDeduplicatedTotal)
+	prometheus.MustRegister(metricSSHClientEvictionsTotal)
+	prometheus.MustRegister(metricSSHHandshakeQueueDepth)
+	prometheus.MustRegister(metricSSHHandshakeQueueWait)
 	prometheus.MustRegister(metricRequestDuration)
 	prometheus.MustRegister(metricRequestsTotal)
+	prometheus.MustRegister(metricRequestsInflight)
+	prometheus.MustRegister(metricShutdownDraining)
+	prometheus.MustRegister(metricShutdownRemainingChannels)
+	prometheus.MustRegister(metricConfigLastReloadSuccessful)
+	prometheus.MustRegister(metricConfigLastReloadSuccessTimestamp)
 	prometheus.MustRegister(metricRequestsFailedTotal)
 	prometheus.MustRegister(metricErrorsByType)
+	prometheus.MustRegister(metricSSHCertificateValidity)
+	prometheus.MustRegister(metricSSHAuthKeyAcceptedTotal)
 }
 
-func setupMetrics(addr string) {
+// metricsWriteTimeout limits the time for handling a request on the
+// metrics listener.
+const metricsWriteTimeout = 10 * time.Second
+
+func setupMetrics(addr string, t *sshTransport) {
 	if addr == "" {
 		return
 	}
 	log.WithFields(log.Fields{"addr": addr}).Info("Serving metrics")
+	mux := http.NewServeMux()
+	mux.Handle("/", promhttp.Handler())
+	t.registerHealthEndpoints(mux)
+	if *adminAPI {
+		log.WithFields(log.Fields{"addr": addr}).Info("Serving admin API")
+		t.registerAdminAPI(mux)
+	}
 	s := &http.Server{
 		Addr:           addr,
-		Handler:        promhttp.Handler(),
+		Handler:        mux,
 		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+		WriteTimeout:   metricsWriteTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
 	go func() {
@@ -3,11 +3,13 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/model/labels"
@@ -16,16 +18,39 @@ import (
 )
 
 type proxyHandler struct {
-	ssh         *sshTransport
-	enableHTTPS bool
+	ssh *sshTransport
 }
 
-func NewProxyHandler(ssh *sshTransport, enableHTTPS bool) *proxyHandler {
-	return &proxyHandler{ssh: ssh, enableHTTPS: enableHTTPS}
+func NewProxyHandler(ssh *sshTransport) *proxyHandler {
+	return &proxyHandler{ssh: ssh}
 }
 
+// requestsInflight counts the proxy requests (including CONNECT and SOCKS)
+// which are currently being handled.
+var requestsInflight atomic.Int64
+
 func (ph *proxyHandler) ServeHTTP(rw http.ResponseWriter, origReq *http.Request) {
-	proxyReq := NewProxyRequest(rw, origReq, ph.ssh.TransportRegular, ph.ssh.TransportTLSSkipVerify, ph.enableHTTPS)
+	requestsInflight.Add(1)
+	defer requestsInflight.Add(-1)
+	if origReq.Method == http.MethodConnect {
+		err := ph.serveConnect(rw, origReq)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"method": origReq.Method,
+				"host":   origReq.Host,
+				"err":    err,
+			}).Debug("request failed")
+		}
+		return
+	}
+	// only enable HTTPS and unix socket support at the last sshified
+	// instance in a cascading setup:
+	enableHTTPS := ph.ssh.isFinalHop(origReq.Host)
+	transportUnixSocket := ph.ssh.TransportUnixSocket
+	if !enableHTTPS {
+		transportUnixSocket = nil
+	}
+	proxyReq := NewProxyRequest(rw, origReq, ph.ssh.TransportRegular, ph.ssh.TransportTLSSkipVerify, transportUnixSocket, enableHTTPS)
 	err := proxyReq.Handle()
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -42,6 +67,8 @@ type proxyRequest struct {
 	origReq                 *http.Request
 	transportRegular        http.RoundTripper
 	transportTLSSkipVerify  http.RoundTripper
+	transportUnixSocket     http.RoundTripper
+	unixSocket              string
 	requestedURL            string
 	upstreamClient          *http.Client
 	upstreamResponse        *http.Response
@@ -50,12 +77,13 @@ type proxyRequest struct {
 	httpsInsecureSkipVerify bool
 }
 
-func NewProxyRequest(rw http.ResponseWriter, origReq *http.Request, transportRegular, transportTLSSkipVerify http.RoundTripper, enableHTTPS bool) *proxyRequest {
+func NewProxyRequest(rw http.ResponseWriter, origReq *http.Request, transportRegular, transportTLSSkipVerify, transportUnixSocket http.RoundTripper, enableHTTPS bool) *proxyRequest {
 	return &proxyRequest{
 		rw:                     rw,
 		origReq:                origReq,
 		transportRegular:       transportRegular,
 		transportTLSSkipVerify: transportTLSSkipVerify,
+		transportUnixSocket:    transportUnixSocket,
 		enableHTTPS:            enableHTTPS,
 	}
 }
@@ -64,6 +92,10 @@ func (pr *proxyRequest) Handle() error {
 	metricRequestsTotal.Inc()
 	timer := prometheus.NewTimer(metricRequestDuration)
 	defer timer.ObserveDuration()
+	if err := pr.prepareUnixSocket(); err != nil {
+		metricRequestsFailedTotal.Inc()
+		return err
+	}
 	pr.prepareHTTPSURL()
 	pr.buildURL()
 	log.WithFields(log.Fields{
@@ -118,7 +150,11 @@ func (pr *proxyRequest) buildURL() {
 
 func (pr *proxyRequest) buildRequest() error {
 	log.WithFields(log.Fields{"method": pr.origReq.Method, "url": pr.requestedURL}).Trace("building upstream request")
-	req, err := http.NewRequest(pr.origReq.Method, pr.requestedURL, nil)
+	ctx := context.Background()
+	if pr.unixSocket != "" {
+		ctx = withUnixSocket(ctx, pr.unixSocket)
+	}
+	req, err := http.NewRequestWithContext(ctx, pr.origReq.Method, pr.requestedURL, nil)
 	pr.upstreamRequest = req
 	if err != nil {
 		pr.rw.WriteHeader(http.StatusInternalServerError)
@@ -140,7 +176,9 @@ func (pr *proxyRequest) buildRequest() error {
 	}
 	pr.upstreamRequest.Body = pr.origReq.Body
 	var transport http.RoundTripper
-	if pr.httpsInsecureSkipVerify {
+	if pr.unixSocket != "" {
+		transport = pr.transportUnixSocket
+	} else if pr.httpsInsecureSkipVerify {
 		transport = pr.transportTLSSkipVerify
 	} else {
 		transport = pr.transportRegular
@@ -157,7 +195,12 @@ func (pr *proxyRequest) sendRequest() error {
 	upstreamResponse, err := pr.upstreamClient.Do(pr.upstreamRequest)
 	log.Trace("finished http request")
 	if err != nil {
-		pr.rw.WriteHeader(http.StatusBadGateway)
+		var backoffErr *backoffError
+		if errors.As(err, &backoffErr) {
+			http.Error(pr.rw, "ssh connection to target host failed recently, not retrying yet", http.StatusBadGateway)
+		} else {
+			pr.rw.WriteHeader(http.StatusBadGateway)
+		}
 		log.WithFields(log.Fields{"err": err}).Debug("upstream request failed")
 		metricErrorsByType.WithLabelValues("upstream_request").Inc()
 		return errors.New("upstream request failed")
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshState is an immutable snapshot of the configuration along with
+// everything derived from it. It is swapped as a whole on reload, so
+// each operation should obtain it once and use it throughout.
+type sshState struct {
+	config *config
+	files  *sshFiles
+	router *router
+	agents map[string]*sshAgent
+}
+
+// newSSHState loads all files referenced by config. Agents and next
+// proxies of the previous state (if any) are reused.
+func newSSHState(config *config, nextProxyAddrs []string, previous *sshState) (*sshState, error) {
+	files, err := loadSSHFiles(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &sshState{
+		config: config,
+		files:  files,
+		agents: make(map[string]*sshAgent),
+	}
+	var previousRouter *router
+	if previous != nil {
+		previousRouter = previous.router
+	}
+	s.router = newRouter(config.Routes, nextProxyAddrs, previousRouter)
+	for _, socket := range config.agentSockets() {
+		if previous != nil && previous.agents[socket] != nil {
+			s.agents[socket] = previous.agents[socket]
+			continue
+		}
+		s.agents[socket] = newSSHAgent(socket)
+	}
+	return s, nil
+}
+
+// Reload validates and applies the given config, re-reading all key and
+// known hosts files. The previous config stays in use if this fails.
+// Pooled clients whose connection settings changed are drained and
+// re-established, all others are kept.
+func (t *sshTransport) Reload(config *config) error {
+	t.reloadMtx.Lock()
+	defer t.reloadMtx.Unlock()
+	previous := t.state.Load()
+	state, err := newSSHState(config, t.nextProxyAddrs, previous)
+	if err != nil {
+		return err
+	}
+	t.state.Store(state)
+	metricSSHCertificateValidity.Set(state.files.certs)
+	for socket, a := range previous.agents {
+		if state.agents[socket] == nil {
+			a.Close()
+		}
+	}
+	t.rebuildChangedClients(previous, state)
+	return nil
+}
+
+// rebuildChangedClients removes all pooled clients which would be
+// established differently with the new state. They are closed once their
+// inflight channels have finished and a replacement is established in
+// the background.
+func (t *sshTransport) rebuildChangedClients(previous, state *sshState) {
+	for host, clients := range t.sshClientPool.all() {
+		changed := false
+		for _, client := range clients {
+			if !connectionChanged(previous, state, host, client) {
+				continue
+			}
+			log.WithFields(log.Fields{"host": host}).Info("ssh settings changed, re-establishing ssh connection")
+			t.sshClientPool.delete(host, client)
+			_ = client.CloseWhenFinished()
+			metricSSHClientEvictionsTotal.WithLabelValues("config_change").Inc()
+			changed = true
+		}
+		if changed && t.backoffs.check(host) == nil {
+			t.sshClientPool.startDial(host, func() (*trackingSSHClient, error) {
+				return t.connectSSHClient(host)
+			})
+		}
+	}
+}
+
+// connectionChanged reports whether client would be established
+// differently with the new state: with other connection settings, other
+// keys or with a host key which is no longer accepted.
+func connectionChanged(previous, state *sshState, host string, client *trackingSSHClient) bool {
+	before, after := previous.config.forHost(host), state.config.forHost(host)
+	if before.HostName != after.HostName || before.User != after.User || before.Port != after.Port ||
+		before.ProxyJump != after.ProxyJump || before.AgentSocket != after.AgentSocket {
+		return true
+	}
+	if !slices.Equal(keyFingerprints(before, previous.files), keyFingerprints(after, state.files)) {
+		return true
+	}
+	knownHosts := state.files.knownHosts[after.KnownHostsFile]
+	if knownHosts == nil || client.hostKey == nil {
+		return true
+	}
+	return knownHosts.callback(client.sshAddr, client.Client.RemoteAddr(), client.hostKey) != nil
+}
+
+// keyFingerprints returns the fingerprints of the keys used for the given
+// settings. Certificates are represented by their key, so renewing a
+// certificate does not require new connections.
+func keyFingerprints(settings targetConfig, files *sshFiles) []string {
+	signers, _ := keySigners(settings, files)
+	var fingerprints []string
+	for _, ns := range signers {
+		key := ns.signer.PublicKey()
+		if cert, ok := key.(*ssh.Certificate); ok {
+			key = cert.Key
+		}
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+	}
+	return fingerprints
+}
+
+// reloadConfig re-reads the config files given on the command line along
+// with all referenced files and applies them.
+// It is triggered by SIGHUP and by the file watcher.
+func reloadConfig(t *sshTransport) error {
+	config, err := loadConfigFromFlags()
+	if err == nil {
+		err = t.Reload(config)
+	}
+	if err != nil {
+		metricConfigLastReloadSuccessful.Set(0)
+		log.WithFields(log.Fields{"err": err}).Error("reload failed")
+		return err
+	}
+	metricConfigLastReloadSuccessful.Set(1)
+	metricConfigLastReloadSuccessTimestamp.Set(float64(time.Now().Unix()))
+	log.Info("successfully reloaded")
+	return nil
+}
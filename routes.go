@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// routeDirect is the next proxy value for connecting to targets directly.
+const routeDirect = "direct"
+
+// nextProxyRetryInterval is the time for which a failed next proxy is
+// only used as a last resort before it is tried first again.
+const nextProxyRetryInterval = 30 * time.Second
+
+// routeConfig selects the next proxies for all targets matching one of
+// the given host glob patterns, domains (including subdomains) or
+// networks (for targets given as IP addresses).
+type routeConfig struct {
+	Hosts       []string `yaml:"hosts"`
+	Domains     []string `yaml:"domains"`
+	CIDRs       []string `yaml:"cidrs"`
+	NextProxies []string `yaml:"next_proxies"`
+}
+
+func (rc routeConfig) validate() error {
+	if len(rc.Hosts) == 0 && len(rc.Domains) == 0 && len(rc.CIDRs) == 0 {
+		return fmt.Errorf("neither hosts, domains nor cidrs given")
+	}
+	for _, pattern := range rc.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %q", pattern)
+		}
+	}
+	for _, cidr := range rc.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid cidr %q", cidr)
+		}
+	}
+	return validateNextProxies(rc.NextProxies)
+}
+
+// validateNextProxies checks that the given list consists either of
+// next proxy addresses or only of routeDirect.
+func validateNextProxies(nextProxies []string) error {
+	if len(nextProxies) == 0 {
+		return fmt.Errorf("no next proxies given")
+	}
+	for _, addr := range nextProxies {
+		if addr == routeDirect {
+			if len(nextProxies) > 1 {
+				return fmt.Errorf("%q cannot be combined with other next proxies", routeDirect)
+			}
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid next proxy address %q: %s", addr, err)
+		}
+	}
+	return nil
+}
+
+// nextProxy tracks the health of a next proxy which is shared by
+// all routes using it.
+type nextProxy struct {
+	addr       string
+	mtx        sync.Mutex
+	failedAt   time.Time
+	lastFailed bool
+}
+
+// preferred reports whether the next proxy should be tried before
+// those which failed recently.
+func (p *nextProxy) preferred() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return !p.lastFailed || time.Since(p.failedAt) > nextProxyRetryInterval
+}
+
+func (p *nextProxy) markResult(err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if err != nil {
+		if !p.lastFailed {
+			log.WithFields(log.Fields{"nextProxy": p.addr, "err": err}).Warn("next proxy failed")
+		}
+		p.lastFailed = true
+		p.failedAt = time.Now()
+		metricNextProxyHealthy.WithLabelValues(p.addr).Set(0)
+		return
+	}
+	if p.lastFailed {
+		log.WithFields(log.Fields{"nextProxy": p.addr}).Info("next proxy recovered")
+	}
+	p.lastFailed = false
+	metricNextProxyHealthy.WithLabelValues(p.addr).Set(1)
+}
+
+type route struct {
+	routeConfig
+	networks    []*net.IPNet
+	nextProxies []*nextProxy
+}
+
+// matches reports whether the route applies to the given (lower-cased) host.
+func (r *route) matches(host string) bool {
+	for _, pattern := range r.Hosts {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return true
+		}
+	}
+	for _, domain := range r.Domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range r.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isDirect reports whether targets are connected to without a next proxy.
+func (r *route) isDirect() bool {
+	return len(r.nextProxies) == 0
+}
+
+// failoverOrder returns the next proxies in the order in which they
+// should be tried: all preferred ones in configuration order, followed
+// by those which failed recently.
+func (r *route) failoverOrder() []*nextProxy {
+	var preferred, failed []*nextProxy
+	for _, p := range r.nextProxies {
+		if p.preferred() {
+			preferred = append(preferred, p)
+		} else {
+			failed = append(failed, p)
+		}
+	}
+	return append(preferred, failed...)
+}
+
+// router chooses the route for a target.
+// Routes are matched in configuration order, targets without a matching
+// route use the default route.
+type router struct {
+	routes       []*route
+	defaultRoute *route
+	nextProxies  map[string]*nextProxy
+}
+
+// newRouter builds the routes for the given config. The health of next
+// proxies which are already known to the previous router (if any) is kept.
+func newRouter(routeConfigs []routeConfig, defaultNextProxies []string, previous *router) *router {
+	nextProxies := make(map[string]*nextProxy)
+	newRoute := func(rc routeConfig) *route {
+		r := &route{routeConfig: rc}
+		for _, cidr := range rc.CIDRs {
+			// already validated as part of the config:
+			if _, network, err := net.ParseCIDR(cidr); err == nil {
+				r.networks = append(r.networks, network)
+			}
+		}
+		for _, addr := range rc.NextProxies {
+			if addr == routeDirect {
+				continue
+			}
+			p, exists := nextProxies[addr]
+			if !exists && previous != nil {
+				p, exists = previous.nextProxies[addr]
+				if exists {
+					nextProxies[addr] = p
+				}
+			}
+			if !exists {
+				p = &nextProxy{addr: addr}
+				nextProxies[addr] = p
+				metricNextProxyHealthy.WithLabelValues(addr).Set(1)
+			}
+			r.nextProxies = append(r.nextProxies, p)
+		}
+		return r
+	}
+	rt := &router{nextProxies: nextProxies}
+	rt.defaultRoute = newRoute(routeConfig{NextProxies: defaultNextProxies})
+	for _, rc := range routeConfigs {
+		rt.routes = append(rt.routes, newRoute(rc))
+	}
+	return rt
+}
+
+// routeFor returns the route for the given host.
+func (rt *router) routeFor(host string) *route {
+	host = strings.ToLower(host)
+	for _, r := range rt.routes {
+		if r.matches(host) {
+			return r
+		}
+	}
+	return rt.defaultRoute
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// drainProgressInterval is the interval at which the progress of a
+// graceful shutdown is logged.
+const drainProgressInterval = 5 * time.Second
+
+// drain shuts down the proxy server gracefully: it stops accepting new
+// requests, waits for inflight ones and then closes all pooled ssh clients
+// once their remaining channels (e.g. CONNECT tunnels) have finished.
+// Waiting is given up after gracePeriod.
+func drain(s *http.Server, t *sshTransport, gracePeriod time.Duration) {
+	draining.Store(true)
+	metricShutdownDraining.Set(1)
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	start := time.Now()
+	ticker := time.NewTicker(drainProgressInterval)
+	defer ticker.Stop()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(ctx)
+	}()
+	for waiting := true; waiting; {
+		select {
+		case err := <-shutdownErr:
+			if err != nil {
+				log.WithFields(log.Fields{"err": err, "inflightRequests": requestsInflight.Load()}).Warn("grace period expired while waiting for inflight requests")
+			}
+			waiting = false
+		case <-ticker.C:
+			log.WithFields(log.Fields{"inflightRequests": requestsInflight.Load(), "elapsed": time.Since(start).Round(time.Second)}).Info("waiting for inflight requests")
+		}
+	}
+
+	t.closeIdleConnections()
+	clients := t.sshClientPool.deleteAll()
+	log.WithFields(log.Fields{"clients": len(clients)}).Info("closing ssh connections")
+	for _, c := range clients {
+		_ = c.CloseWhenFinished()
+	}
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+	for {
+		var remaining int64
+		for _, c := range clients {
+			remaining += c.inflight()
+		}
+		metricShutdownRemainingChannels.Set(float64(remaining))
+		if remaining == 0 {
+			log.WithFields(log.Fields{"elapsed": time.Since(start).Round(time.Millisecond)}).Info("drained all connections")
+			return
+		}
+		select {
+		case <-poll.C:
+		case <-ticker.C:
+			log.WithFields(log.Fields{"remainingChannels": remaining, "elapsed": time.Since(start).Round(time.Second)}).Info("waiting for ssh channels to finish")
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"remainingChannels": remaining}).Warn("grace period expired, aborting remaining ssh channels")
+			return
+		}
+	}
+}
+
+// closeIdleConnections closes the kept-alive upstream HTTP connections
+// which would otherwise keep their ssh channels open.
+func (t *sshTransport) closeIdleConnections() {
+	for _, rt := range []http.RoundTripper{t.TransportRegular, t.TransportTLSSkipVerify, t.TransportUnixSocket} {
+		if ht, ok := rt.(*http.Transport); ok {
+			ht.CloseIdleConnections()
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SOCKS5 protocol constants, see RFC 1928.
+const (
+	socksVersion5           = 0x05
+	socksMethodNoAuth       = 0x00
+	socksMethodNoAcceptable = 0xff
+	socksCmdConnect         = 0x01
+	socksAtypIPv4           = 0x01
+	socksAtypDomain         = 0x03
+	socksAtypIPv6           = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAtypNotSupported    = 0x08
+)
+
+// socksHandshakeTimeout limits the time a client may take for the
+// SOCKS negotiation, similar to the http server's ReadTimeout.
+const socksHandshakeTimeout = 10 * time.Second
+
+// socksServer accepts SOCKS5 CONNECT requests and forwards them over
+// the same sshTransport as the HTTP proxy.
+type socksServer struct {
+	ssh *sshTransport
+}
+
+func NewSOCKSServer(ssh *sshTransport) *socksServer {
+	return &socksServer{ssh: ssh}
+}
+
+func (s *socksServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := s.serveConn(conn)
+			if err != nil {
+				log.WithFields(log.Fields{"remote": conn.RemoteAddr(), "err": err}).Debug("socks request failed")
+			}
+		}()
+	}
+}
+
+func (s *socksServer) serveConn(conn net.Conn) error {
+	defer func() { _ = conn.Close() }()
+	requestsInflight.Add(1)
+	defer requestsInflight.Add(-1)
+	metricRequestsTotal.Inc()
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	addr, err := s.negotiate(conn)
+	if err != nil {
+		metricRequestsFailedTotal.Inc()
+		metricErrorsByType.WithLabelValues("socks_protocol").Inc()
+		return err
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	if !connectAllowedPorts.contains(port) {
+		metricRequestsFailedTotal.Inc()
+		metricErrorsByType.WithLabelValues("connect_port_denied").Inc()
+		_ = writeSOCKSReply(conn, socksReplyNotAllowed)
+		return fmt.Errorf("tunneling to port %s is not allowed", port)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutDurationSeconds)
+	upstream, err := s.ssh.dialTunnel(ctx, addr)
+	cancel()
+	if err != nil {
+		metricRequestsFailedTotal.Inc()
+		metricErrorsByType.WithLabelValues("upstream_request").Inc()
+		var backoffErr *backoffError
+		if errors.As(err, &backoffErr) {
+			_ = writeSOCKSReply(conn, socksReplyHostUnreachable)
+		} else {
+			_ = writeSOCKSReply(conn, socksReplyGeneralFailure)
+		}
+		return fmt.Errorf("upstream tunnel failed: %s", err)
+	}
+	defer func() { _ = upstream.Close() }()
+	if err := writeSOCKSReply(conn, socksReplySucceeded); err != nil {
+		metricRequestsFailedTotal.Inc()
+		return fmt.Errorf("failed to confirm tunnel: %s", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	log.WithFields(log.Fields{"addr": addr}).Trace("socks tunnel established")
+	// SOCKS clients (e.g. database clients) tend to keep idle connections
+	// open for a long time, so no idle timeout is enforced here.
+	// Dead connections are detected by TCP keepalives or the SSH connection
+	// being closed.
+	spliceConns(conn, conn, upstream, 0)
+	return nil
+}
+
+// negotiate performs the method selection and reads the CONNECT request.
+// It returns the requested address as host:port.
+func (s *socksServer) negotiate(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("failed to read greeting: %s", err)
+	}
+	if header[0] != socksVersion5 {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", fmt.Errorf("failed to read auth methods: %s", err)
+	}
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = socksMethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion5, method}); err != nil {
+		return "", err
+	}
+	if method == socksMethodNoAcceptable {
+		return "", errors.New("client does not support unauthenticated access")
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", fmt.Errorf("failed to read request: %s", err)
+	}
+	if req[0] != socksVersion5 {
+		return "", fmt.Errorf("unsupported socks version %d", req[0])
+	}
+	if req[1] != socksCmdConnect {
+		_ = writeSOCKSReply(conn, socksReplyCommandNotSupported)
+		return "", fmt.Errorf("unsupported socks command %d", req[1])
+	}
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", fmt.Errorf("failed to read address: %s", err)
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return "", fmt.Errorf("failed to read address: %s", err)
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", fmt.Errorf("failed to read address: %s", err)
+		}
+		host = string(domain)
+	default:
+		_ = writeSOCKSReply(conn, socksReplyAtypNotSupported)
+		return "", fmt.Errorf("unsupported socks address type %d", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", fmt.Errorf("failed to read port: %s", err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSOCKSReply sends a reply with the given code. The bound address
+// is not meaningful for tunnels over SSH and is always reported as 0.0.0.0:0.
+func writeSOCKSReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion5, code, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -6,48 +6,187 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// sshClientPool holds the established ssh connections.
+// There may be several connections per host, new channels are opened
+// on the least loaded one.
 type sshClientPool struct {
-	pool map[string]*trackingSSHClient
-	lock *sync.RWMutex
+	pool  map[string][]*trackingSSHClient
+	dials map[string]*sshDial
+	lock  *sync.RWMutex
+}
+
+// sshDial is an inflight attempt to establish a new ssh connection.
+// Its result is shared with all concurrent requests for the same host.
+type sshDial struct {
+	done   chan struct{}
+	client *trackingSSHClient
+	err    error
 }
 
 func newSSHClientPool() *sshClientPool {
 	p := &sshClientPool{
-		pool: make(map[string]*trackingSSHClient),
-		lock: &sync.RWMutex{},
+		pool:  make(map[string][]*trackingSSHClient),
+		dials: make(map[string]*sshDial),
+		lock:  &sync.RWMutex{},
 	}
 	return p
 }
 
-func (p *sshClientPool) delete(host string) {
+// delete removes the given client of host from the pool.
+func (p *sshClientPool) delete(host string, client *trackingSSHClient) {
 	p.lock.Lock()
-	_, cached := p.pool[host]
-	if cached {
-		delete(p.pool, host)
+	defer p.lock.Unlock()
+	p.deleteLocked(host, client)
+}
+
+func (p *sshClientPool) deleteLocked(host string, client *trackingSSHClient) {
+	clients := p.pool[host]
+	for i, c := range clients {
+		if c != client {
+			continue
+		}
+		clients = append(clients[:i:i], clients[i+1:]...)
+		if len(clients) == 0 {
+			p.deleteHostLocked(host)
+		} else {
+			p.pool[host] = clients
+		}
 		metricSshclientPool.Dec()
+		return
 	}
-	p.lock.Unlock()
 }
 
-func (p *sshClientPool) get(host string) (*trackingSSHClient, bool) {
+// get returns the least loaded client for host along with the
+// number of clients for host.
+func (p *sshClientPool) get(host string) (*trackingSSHClient, int) {
 	log.Trace("acquiring cache lock")
 	p.lock.RLock()
 	defer p.lock.RUnlock()
-	client, cached := p.pool[host]
-	return client, cached
+	return p.leastLoadedLocked(host), len(p.pool[host])
 }
 
-// setOrGetCached checks if a client is already cached for the given
-// host. If yes, it returns the cached client.
-// If not, it puts the given client into the cache.
-func (p *sshClientPool) setOrGetCached(host string, client *trackingSSHClient) (*trackingSSHClient, bool) {
+func (p *sshClientPool) leastLoadedLocked(host string) *trackingSSHClient {
+	var leastLoaded *trackingSSHClient
+	var leastInflight int64
+	for _, c := range p.pool[host] {
+		inflight := c.inflight()
+		if leastLoaded == nil || inflight < leastInflight {
+			leastLoaded, leastInflight = c, inflight
+		}
+	}
+	return leastLoaded
+}
+
+// add puts the given client into the pool unless there are already
+// maxClients clients for host. In that case, it returns the least
+// loaded of the existing clients and false, which is never nil.
+// maxClients below 1 is treated as 1.
+func (p *sshClientPool) add(host string, client *trackingSSHClient, maxClients int) (*trackingSSHClient, bool) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
-	cachedClient, cached := p.pool[host]
-	if cached {
-		return cachedClient, cached
+	if len(p.pool[host]) >= max(maxClients, 1) {
+		return p.leastLoadedLocked(host), false
 	}
-	p.pool[host] = client
+	p.pool[host] = append(p.pool[host], client)
 	metricSshclientPool.Inc()
-	return nil, false
+	return client, true
+}
+
+// all returns a copy of all pooled clients by host.
+func (p *sshClientPool) all() map[string][]*trackingSSHClient {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	clients := make(map[string][]*trackingSSHClient, len(p.pool))
+	for host, c := range p.pool {
+		clients[host] = append([]*trackingSSHClient(nil), c...)
+	}
+	return clients
+}
+
+// deleteHost removes all clients of host from the pool and returns them.
+func (p *sshClientPool) deleteHost(host string) []*trackingSSHClient {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	clients := p.pool[host]
+	p.deleteHostLocked(host)
+	metricSshclientPool.Sub(float64(len(clients)))
+	return clients
+}
+
+// deleteAll removes all clients from the pool and returns them.
+func (p *sshClientPool) deleteAll() []*trackingSSHClient {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var clients []*trackingSSHClient
+	for host, c := range p.pool {
+		clients = append(clients, c...)
+		p.deleteHostLocked(host)
+		metricSshclientPool.Sub(float64(len(c)))
+	}
+	return clients
+}
+
+// deleteHostLocked removes host from the pool along with its per-host
+// metrics, so that hosts which are gone do not keep their series forever.
+func (p *sshClientPool) deleteHostLocked(host string) {
+	delete(p.pool, host)
+	metricSSHKeepaliveRTT.DeleteLabelValues(host)
+}
+
+// deleteDependents removes all clients which have been connected via
+// the given jump host client (directly or indirectly) and returns them
+// by host.
+func (p *sshClientPool) deleteDependents(jumpClient *trackingSSHClient) map[*trackingSSHClient]string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	dependents := make(map[*trackingSSHClient]string)
+	jumpClients := []*trackingSSHClient{jumpClient}
+	for len(jumpClients) > 0 {
+		jumpClient, jumpClients = jumpClients[0], jumpClients[1:]
+		for host, clients := range p.pool {
+			for _, client := range clients {
+				if client.jumpClient != jumpClient {
+					continue
+				}
+				dependents[client] = host
+				p.deleteLocked(host, client)
+				jumpClients = append(jumpClients, client)
+			}
+		}
+	}
+	return dependents
+}
+
+// dialOnce calls dial to establish a new client for the given host unless
+// another dial for the same host is already inflight. In that case,
+// it waits for that dial and returns its result instead.
+func (p *sshClientPool) dialOnce(host string, dial func() (*trackingSSHClient, error)) (*trackingSSHClient, error) {
+	d, started := p.startDial(host, dial)
+	if !started {
+		log.WithFields(log.Fields{"host": host}).Trace("waiting for inflight ssh connection attempt")
+		metricSSHDialsDeduplicatedTotal.Inc()
+	}
+	<-d.done
+	return d.client, d.err
+}
+
+// startDial starts dial in the background unless another dial for the
+// same host is already inflight. It returns the inflight dial and
+// whether it has been started by this call.
+func (p *sshClientPool) startDial(host string, dial func() (*trackingSSHClient, error)) (*sshDial, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if d, inflight := p.dials[host]; inflight {
+		return d, false
+	}
+	d := &sshDial{done: make(chan struct{})}
+	p.dials[host] = d
+	go func() {
+		d.client, d.err = dial()
+		p.lock.Lock()
+		delete(p.dials, host)
+		p.lock.Unlock()
+		close(d.done)
+	}()
+	return d, true
 }
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSSHConfigIncludeDepth limits nested Include directives.
+const maxSSHConfigIncludeDepth = 16
+
+// sshConfig holds the supported subset of an OpenSSH ssh_config file:
+// Host and Match host blocks with HostName, User, Port, IdentityFile,
+// UserKnownHostsFile and ProxyJump.
+type sshConfig struct {
+	blocks []sshConfigBlock
+	// enclosing is the index of the block containing the Include
+	// which is currently being parsed, or -1.
+	enclosing int
+}
+
+// sshConfigBlock is a Host or Match block (or the settings before the
+// first block, which apply to all hosts).
+type sshConfigBlock struct {
+	// hostPatterns are the patterns of a Host line.
+	hostPatterns []string
+	// criteria are the criteria of a Match line, all of which have to match.
+	criteria []sshConfigCriterion
+	// enclosing is the index of the block containing the Include which
+	// this block has been read from, or -1. Like in ssh, the block only
+	// applies if the enclosing block does.
+	enclosing int
+	settings  targetConfig
+}
+
+type sshConfigCriterion struct {
+	keyword  string
+	patterns []string
+}
+
+// loadSSHConfig parses the ssh_config file at the given path.
+func loadSSHConfig(filename string) (*sshConfig, error) {
+	sc := &sshConfig{blocks: []sshConfigBlock{{hostPatterns: []string{"*"}, enclosing: -1}}, enclosing: -1}
+	if err := sc.parseFile(filename, 0); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (sc *sshConfig) parseFile(filename string, depth int) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("unable to read ssh config file %s: %s", filename, err)
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, lineNo, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		if err := sc.parseDirective(filename, depth, keyword, args); err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read ssh config file %s: %s", filename, err)
+	}
+	return nil
+}
+
+// splitSSHConfigLine returns the lower-cased keyword and the arguments of
+// a line in the form "Keyword arg..." or "Keyword=arg...".
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword, rest := line[:i], strings.TrimSpace(line[i:])
+	rest = strings.TrimPrefix(rest, "=")
+	args, err := splitSSHConfigArgs(rest)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.ToLower(keyword), args, nil
+}
+
+// splitSSHConfigArgs splits s into arguments like OpenSSH's argv_split:
+// arguments are separated by whitespace, which can be included using
+// single or double quotes. A backslash escapes quotes, backslashes and,
+// outside of quotes, spaces. An unquoted argument starting with # ends
+// the line.
+func splitSSHConfigArgs(s string) ([]string, error) {
+	var args []string
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			continue
+		}
+		if s[i] == '#' {
+			break
+		}
+		var arg strings.Builder
+		var quote byte
+		for ; i < len(s); i++ {
+			c := s[i]
+			if quote == 0 && (c == ' ' || c == '\t') {
+				break
+			}
+			switch {
+			case c == '\\' && i+1 < len(s) && (strings.IndexByte(`'"\`, s[i+1]) >= 0 || quote == 0 && s[i+1] == ' '):
+				i++
+				arg.WriteByte(s[i])
+			case quote == 0 && (c == '"' || c == '\''):
+				quote = c
+			case quote != 0 && c == quote:
+				quote = 0
+			default:
+				arg.WriteByte(c)
+			}
+		}
+		if quote != 0 {
+			return nil, fmt.Errorf("unterminated quote")
+		}
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+func (sc *sshConfig) parseDirective(filename string, depth int, keyword string, args []string) error {
+	switch keyword {
+	case "host":
+		if len(args) == 0 {
+			return fmt.Errorf("Host requires at least one pattern")
+		}
+		sc.blocks = append(sc.blocks, sshConfigBlock{hostPatterns: args, enclosing: sc.enclosing})
+		return nil
+	case "match":
+		criteria, err := parseSSHConfigMatch(args)
+		if err != nil {
+			return err
+		}
+		sc.blocks = append(sc.blocks, sshConfigBlock{criteria: criteria, enclosing: sc.enclosing})
+		return nil
+	case "include":
+		return sc.include(filename, depth, args)
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%s requires an argument", keyword)
+	}
+	settings := &sc.blocks[len(sc.blocks)-1].settings
+	// like ssh, the first obtained value is used:
+	switch keyword {
+	case "hostname":
+		// %h is expanded in forHost, once the host is known:
+		if strings.Contains(strings.NewReplacer("%%", "", "%h", "").Replace(args[0]), "%") {
+			return fmt.Errorf("unsupported token in HostName %q: only %%h and %%%% are supported", args[0])
+		}
+		if settings.HostName == "" {
+			settings.HostName = args[0]
+		}
+	case "user":
+		if settings.User == "" {
+			settings.User = args[0]
+		}
+	case "port":
+		port, err := strconv.Atoi(args[0])
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %q", args[0])
+		}
+		if settings.Port == 0 {
+			settings.Port = port
+		}
+	case "identityfile":
+		keyFile, err := expandSSHConfigPath(args[0])
+		if err != nil {
+			return err
+		}
+		// identity files are cumulative:
+		settings.KeyFiles = append(settings.KeyFiles, keyFile)
+	case "userknownhostsfile":
+		knownHostsFile, err := expandSSHConfigPath(args[0])
+		if err != nil {
+			return err
+		}
+		if settings.KnownHostsFile == "" {
+			settings.KnownHostsFile = knownHostsFile
+		}
+	case "proxyjump":
+		if strings.ContainsAny(args[0], "@:,") {
+			return fmt.Errorf("unsupported ProxyJump %q: only a single host name is supported, set User and Port in a separate Host block", args[0])
+		}
+		if settings.ProxyJump == "" {
+			settings.ProxyJump = args[0]
+		}
+	default:
+		log.WithFields(log.Fields{"keyword": keyword}).Trace("ignoring unsupported ssh config keyword")
+	}
+	return nil
+}
+
+// parseSSHConfigMatch parses the criteria of a Match line.
+// Criteria other than host, originalhost, all and final never match.
+func parseSSHConfigMatch(args []string) ([]sshConfigCriterion, error) {
+	var criteria []sshConfigCriterion
+	for i := 0; i < len(args); i++ {
+		keyword := strings.ToLower(args[i])
+		switch keyword {
+		case "all", "canonical", "final":
+			// there is only a single, final pass as hostnames are not
+			// canonicalized:
+			criteria = append(criteria, sshConfigCriterion{keyword: keyword})
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("Match %s requires an argument", keyword)
+		}
+		i++
+		switch keyword {
+		case "host", "originalhost":
+		default:
+			log.WithFields(log.Fields{"criterion": keyword}).Warn("unsupported ssh config Match criterion, ignoring block")
+		}
+		criteria = append(criteria, sshConfigCriterion{keyword: keyword, patterns: strings.Split(args[i], ",")})
+	}
+	if len(criteria) == 0 {
+		return nil, fmt.Errorf("Match requires at least one criterion")
+	}
+	return criteria, nil
+}
+
+// include parses all files matching the given glob patterns.
+// Relative paths are interpreted relative to the including file.
+func (sc *sshConfig) include(filename string, depth int, patterns []string) error {
+	if depth >= maxSSHConfigIncludeDepth {
+		return fmt.Errorf("too many nested Include directives")
+	}
+	for _, pattern := range patterns {
+		pattern, err := expandSSHConfigPath(pattern)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid Include pattern %q", pattern)
+		}
+		for _, match := range matches {
+			// the blocks of an included file only apply if the current
+			// block does and end with the file:
+			blocks := len(sc.blocks)
+			current := sc.blocks[blocks-1]
+			enclosing := sc.enclosing
+			sc.enclosing = blocks - 1
+			err := sc.parseFile(match, depth+1)
+			sc.enclosing = enclosing
+			if err != nil {
+				return err
+			}
+			if len(sc.blocks) > blocks {
+				current.settings = targetConfig{}
+				sc.blocks = append(sc.blocks, current)
+			}
+		}
+	}
+	return nil
+}
+
+// expandSSHConfigPath expands ~ and %d to the home directory.
+// Other tokens are not supported as the files are loaded upfront.
+func expandSSHConfigPath(p string) (string, error) {
+	if strings.HasPrefix(p, "~/") || strings.Contains(p, "%d") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(p, "~/") {
+			p = filepath.Join(home, p[2:])
+		}
+		p = strings.ReplaceAll(p, "%d", home)
+	}
+	if strings.Contains(strings.ReplaceAll(p, "%%", ""), "%") {
+		return "", fmt.Errorf("unsupported token in path %q", p)
+	}
+	return strings.ReplaceAll(p, "%%", "%"), nil
+}
+
+// forHost returns the settings for the given (lower-cased) host.
+func (sc *sshConfig) forHost(host string) targetConfig {
+	var tc targetConfig
+	matched := make([]bool, len(sc.blocks))
+	for i, b := range sc.blocks {
+		if b.enclosing >= 0 && !matched[b.enclosing] {
+			continue
+		}
+		if !b.matches(host, tc.HostName) {
+			continue
+		}
+		matched[i] = true
+		s := b.settings
+		if s.HostName != "" {
+			s.HostName = strings.NewReplacer("%%", "%", "%h", host).Replace(s.HostName)
+		}
+		tc.KeyFiles = append(tc.KeyFiles, s.KeyFiles...)
+		s.KeyFiles = nil
+		// earlier values take precedence:
+		tc = s.merge(tc)
+	}
+	return tc
+}
+
+// matches reports whether the block applies to host. Like in ssh,
+// Match host is checked against the HostName if it has already been set.
+func (b sshConfigBlock) matches(host, hostName string) bool {
+	if b.criteria == nil {
+		return matchSSHPatternList(host, b.hostPatterns)
+	}
+	for _, c := range b.criteria {
+		switch c.keyword {
+		case "all", "final":
+		case "host":
+			target := host
+			if hostName != "" {
+				target = strings.ToLower(hostName)
+			}
+			if !matchSSHPatternList(target, c.patterns) {
+				return false
+			}
+		case "originalhost":
+			if !matchSSHPatternList(host, c.patterns) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// matchSSHPatternList reports whether host matches one of the patterns
+// and none of the negated (!) patterns.
+func matchSSHPatternList(host string, patterns []string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if negated, found := strings.CutPrefix(pattern, "!"); found {
+			if matchSSHPattern(host, negated) {
+				return false
+			}
+			continue
+		}
+		if matchSSHPattern(host, pattern) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchSSHPattern matches s against pattern with the ssh wildcards
+// * (any sequence of characters) and ? (any single character).
+func matchSSHPattern(s, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchSSHPattern(s[i:], pattern[1:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		s, pattern = s[1:], pattern[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	for _, tc := range []struct {
+		line    string
+		keyword string
+		args    []string
+		err     bool
+	}{
+		{line: "", keyword: ""},
+		{line: "  # comment", keyword: ""},
+		{line: "HostName example.org", keyword: "hostname", args: []string{"example.org"}},
+		{line: "\tUser\tmonitoring ", keyword: "user", args: []string{"monitoring"}},
+		{line: "Port=2222", keyword: "port", args: []string{"2222"}},
+		{line: "Port = 2222", keyword: "port", args: []string{"2222"}},
+		{line: `IdentityFile "/etc/ssh keys/id"`, keyword: "identityfile", args: []string{"/etc/ssh keys/id"}},
+		{line: `IdentityFile "/etc/ssh/id"`, keyword: "identityfile", args: []string{"/etc/ssh/id"}},
+		{line: `IdentityFile '/etc/ssh keys/id'`, keyword: "identityfile", args: []string{"/etc/ssh keys/id"}},
+		{line: `IdentityFile /etc/ssh\ keys/id`, keyword: "identityfile", args: []string{"/etc/ssh keys/id"}},
+		{line: `IdentityFile /etc/"ssh keys"/id`, keyword: "identityfile", args: []string{"/etc/ssh keys/id"}},
+		{line: `IdentityFile "/etc/\"ssh\"/id"`, keyword: "identityfile", args: []string{`/etc/"ssh"/id`}},
+		{line: `IdentityFile "/etc/ssh keys/id`, err: true},
+		{line: `Host "a b" c`, keyword: "host", args: []string{"a b", "c"}},
+		{line: "Host a b # trailing comment", keyword: "host", args: []string{"a", "b"}},
+		{line: `Host a "#b"`, keyword: "host", args: []string{"a", "#b"}},
+		{line: "Match", keyword: "match"},
+	} {
+		keyword, args, err := splitSSHConfigLine(tc.line)
+		if tc.err {
+			if err == nil {
+				t.Errorf("splitSSHConfigLine(%q) succeeded, want error", tc.line)
+			}
+			continue
+		}
+		if err != nil || keyword != tc.keyword || !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("splitSSHConfigLine(%q) = %q, %q, %v, want %q, %q", tc.line, keyword, args, err, tc.keyword, tc.args)
+		}
+	}
+}
+
+func TestMatchSSHPatternList(t *testing.T) {
+	for _, tc := range []struct {
+		host     string
+		patterns []string
+		want     bool
+	}{
+		{host: "web1.example.org", patterns: []string{"web1.example.org"}, want: true},
+		{host: "web1.example.org", patterns: []string{"*.example.org"}, want: true},
+		{host: "web1.example.org", patterns: []string{"web?.example.org"}, want: true},
+		{host: "web10.example.org", patterns: []string{"web?.example.org"}, want: false},
+		{host: "web1.example.org", patterns: []string{"WEB1.Example.org"}, want: true},
+		{host: "web1.example.org", patterns: []string{"db*", "web*"}, want: true},
+		{host: "example.org", patterns: []string{"*.example.org"}, want: false},
+		{host: "web1.example.org", patterns: []string{"*", "!web1.example.org"}, want: false},
+		{host: "web1.example.org", patterns: []string{"!web1.example.org", "*"}, want: false},
+		{host: "web2.example.org", patterns: []string{"*.example.org", "!web1.*"}, want: true},
+		{host: "web2.example.org", patterns: []string{"!web1.example.org"}, want: false},
+	} {
+		if got := matchSSHPatternList(tc.host, tc.patterns); got != tc.want {
+			t.Errorf("matchSSHPatternList(%q, %q) = %v, want %v", tc.host, tc.patterns, got, tc.want)
+		}
+	}
+}
+
+func TestSSHConfigForHost(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   string
+		included string
+		host     string
+		want     targetConfig
+	}{
+		{
+			name:   "negated pattern excludes host",
+			config: "Host *.example.org !db.example.org\n  User monitoring\n",
+			host:   "db.example.org",
+			want:   targetConfig{},
+		},
+		{
+			name:   "negated pattern does not exclude other hosts",
+			config: "Host *.example.org !db.example.org\n  User monitoring\n",
+			host:   "web.example.org",
+			want:   targetConfig{User: "monitoring"},
+		},
+		{
+			name:   "negated pattern alone never matches",
+			config: "Host !db.example.org\n  User monitoring\n",
+			host:   "web.example.org",
+			want:   targetConfig{},
+		},
+		{
+			name:   "Match host checks HostName",
+			config: "Host web\n  HostName web.example.org\nMatch host *.example.org\n  User monitoring\n",
+			host:   "web",
+			want:   targetConfig{HostName: "web.example.org", User: "monitoring"},
+		},
+		{
+			name:   "Match host does not check the alias once HostName is set",
+			config: "Host web\n  HostName web.example.org\nMatch host web\n  User monitoring\n",
+			host:   "web",
+			want:   targetConfig{HostName: "web.example.org"},
+		},
+		{
+			name:   "Match originalhost checks the alias",
+			config: "Host web\n  HostName web.example.org\nMatch originalhost web\n  User monitoring\n",
+			host:   "web",
+			want:   targetConfig{HostName: "web.example.org", User: "monitoring"},
+		},
+		{
+			name:   "Match with unsupported criterion never matches",
+			config: "Match user root\n  User monitoring\n",
+			host:   "web",
+			want:   targetConfig{},
+		},
+		{
+			name:   "first value wins",
+			config: "Host web\n  User first\n  User second\n  Port 2222\nHost *\n  User third\n  Port 22\n  HostName web.example.org\n",
+			host:   "web",
+			want:   targetConfig{User: "first", Port: 2222, HostName: "web.example.org"},
+		},
+		{
+			name:   "HostName expands %h",
+			config: "Host web\n  HostName %h.example.org\n",
+			host:   "web",
+			want:   targetConfig{HostName: "web.example.org"},
+		},
+		{
+			name:   "HostName expands %%",
+			config: "Host web\n  HostName %%h.example.org\n",
+			host:   "web",
+			want:   targetConfig{HostName: "%h.example.org"},
+		},
+		{
+			name:   "identity files accumulate",
+			config: "Host web\n  IdentityFile /keys/a\n  IdentityFile /keys/b\nHost *\n  IdentityFile /keys/c\n",
+			host:   "web",
+			want:   targetConfig{KeyFiles: []string{"/keys/a", "/keys/b", "/keys/c"}},
+		},
+		{
+			name:     "Include continues the current block until the first block of the included file",
+			config:   "Host web\n  User outer\n  Include included.conf\n",
+			included: "IdentityFile /keys/included\nHost db\n  User inner\n",
+			host:     "web",
+			want:     targetConfig{User: "outer", KeyFiles: []string{"/keys/included"}},
+		},
+		{
+			name:     "Include in a non-matching block is ignored",
+			config:   "Host web\n  User outer\n  Include included.conf\n  Port 2222\n",
+			included: "Host db\n  User inner\n",
+			host:     "db",
+			want:     targetConfig{},
+		},
+		{
+			name:     "Include in a matching block applies the included blocks",
+			config:   "Host web db\n  User outer\n  Include included.conf\n",
+			included: "Host db\n  User inner\n  Port 2222\n",
+			host:     "db",
+			want:     targetConfig{User: "outer", Port: 2222},
+		},
+		{
+			name:     "Include outside of blocks applies the included blocks",
+			config:   "Include included.conf\nHost web\n  User outer\n",
+			included: "Host db\n  User inner\n",
+			host:     "db",
+			want:     targetConfig{User: "inner"},
+		},
+		{
+			name:     "Include ends the blocks of the included file",
+			config:   "Include included.conf\nPort 2222\n",
+			included: "Host db\n  User inner\n",
+			host:     "web",
+			want:     targetConfig{Port: 2222},
+		},
+		{
+			name:     "Include resumes the current block afterwards",
+			config:   "Host web\n  User outer\n  Include included.conf\n  Port 2222\n",
+			included: "Host db\n  User inner\n",
+			host:     "web",
+			want:     targetConfig{User: "outer", Port: 2222},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "ssh_config")
+			if err := os.WriteFile(filename, []byte(tc.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if tc.included != "" {
+				if err := os.WriteFile(filepath.Join(dir, "included.conf"), []byte(tc.included), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sc, err := loadSSHConfig(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sc.forHost(tc.host); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("forHost(%q) = %+v, want %+v", tc.host, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSSHConfigUnsupportedHostNameToken(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ssh_config")
+	if err := os.WriteFile(filename, []byte("Host web\n  HostName %n.example.org\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSSHConfig(filename); err == nil {
+		t.Fatal("loading ssh config with unsupported HostName token succeeded")
+	}
+}
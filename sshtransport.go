@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -18,31 +19,26 @@ import (
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
-func makePubkeyAuth(keyFile string) ([]ssh.AuthMethod, error) {
-	key, err := os.ReadFile(keyFile)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read private key file %s", keyFile)
-	}
-
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse private key file %s", keyFile)
-	}
-	return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
-
-}
-
 type sshTransport struct {
-	port                   int
-	user                   string
-	auth                   []ssh.AuthMethod
+	// state is replaced as a whole on reload, see sshState.
+	state                  atomic.Pointer[sshState]
+	reloadMtx              sync.Mutex
+	nextProxyAddrs         []string
 	sshClientPool          *sshClientPool
 	TransportRegular       http.RoundTripper
 	TransportTLSSkipVerify http.RoundTripper
-	keyFile                string
-	knownHostsFile         string
-	knownHostsCallback     ssh.HostKeyCallback
-	nextProxyAddr          string
+	TransportUnixSocket    http.RoundTripper
+	backoffs               *hostBackoffs
+	handshakeLimiter       *handshakeLimiter
+}
+
+// sshFiles holds the parsed contents of all key and known hosts files
+// referenced by the config, indexed by file name.
+type sshFiles struct {
+	keyFiles   map[string][]string
+	signers    map[string]ssh.Signer
+	certs      map[string]*ssh.Certificate
+	knownHosts map[string]*knownHosts
 }
 
 // trackingSSHClient wraps an ssh.Client and tracks
@@ -56,40 +52,52 @@ type sshTransport struct {
 type trackingSSHClient struct {
 	*ssh.Client
 	Conn               net.Conn
+	jumpClient         *trackingSSHClient
+	createdAt          time.Time
 	mtx                sync.Mutex
 	inflightConns      int64
+	lastUsed           time.Time
 	shouldClose        bool
 	keepaliveMtx       sync.Mutex
 	keepaliveInflight  bool
 	keepaliveWaitChan  chan struct{}
 	keepaliveStartTime time.Time
 	keepaliveErr       error
+	keepaliveRTT       time.Duration
+	// sshAddr and hostKey are the address and the host key
+	// which have been verified against known_hosts.
+	sshAddr string
+	hostKey ssh.PublicKey
 }
 
 // trackingSSHConn is a wrapper for net.Conn, which is used by
 // trackingSSHClient to ensure that closed connections are properly
-// tracked in the client.
+// tracked in the client. Close may be called multiple times, but
+// closeFunc only runs once.
 type trackingSSHConn struct {
 	net.Conn
+	client    *trackingSSHClient
 	closeFunc func()
+	closeOnce sync.Once
 }
 
-func (conn trackingSSHConn) Close() error {
+func (conn *trackingSSHConn) Close() error {
 	err := conn.Conn.Close()
-	conn.closeFunc()
+	conn.closeOnce.Do(conn.closeFunc)
 	return err
 }
 
 func (c *trackingSSHClient) DialContext(ctx context.Context, n, addr string) (net.Conn, error) {
 	c.mtx.Lock()
 	c.inflightConns++
+	c.lastUsed = time.Now()
 	c.mtx.Unlock()
 	conn, err := c.Client.DialContext(ctx, n, addr)
 	if err != nil {
 		c.connCloseCallback()
 		return conn, err
 	}
-	tc := trackingSSHConn{Conn: conn, closeFunc: c.connCloseCallback}
+	tc := &trackingSSHConn{Conn: conn, client: c, closeFunc: c.connCloseCallback}
 	return tc, err
 }
 
@@ -114,11 +122,8 @@ func (c *trackingSSHClient) SendRequest(name string, wantReply bool, payload []b
 		log.Trace("trackingSSHClient: rejecting SendRequest during client shutdown")
 		return false, nil, errors.New("trackingSSHClient is shutting down")
 	}
-	defer func() {
-		c.mtx.Lock()
-		c.inflightConns--
-		c.mtx.Unlock()
-	}()
+	// requests (e.g. keepalives) do not count as usage of the connection:
+	defer c.release(false)
 	return c.Client.SendRequest(name, wantReply, payload)
 }
 
@@ -159,17 +164,61 @@ func (c *trackingSSHClient) awaitKeepalive() {
 	log.Trace("awaitKeepalive: SendRequest() start")
 	c.Conn.SetDeadline(time.Now().Add(stepTimeoutDurationSeconds))
 	defer c.Conn.SetDeadline(time.Time{})
+	start := time.Now()
 	_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
 	log.WithFields(log.Fields{"err": err}).Trace("awaitKeepalive: SendRequest() returned")
+	if err == nil {
+		c.mtx.Lock()
+		c.keepaliveRTT = time.Since(start)
+		c.mtx.Unlock()
+	}
 	c.keepaliveErr = err
 	c.keepaliveInflight = false
 	close(c.keepaliveWaitChan)
 }
 
+// inflight returns the number of currently open channels and requests.
+func (c *trackingSSHClient) inflight() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.inflightConns
+}
+
+// idleSince returns the time since which the client has no inflight
+// channels or requests (or the zero time if it is in use).
+func (c *trackingSSHClient) idleSince() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.inflightConns > 0 {
+		return time.Time{}
+	}
+	return c.lastUsed
+}
+
 func (c *trackingSSHClient) connCloseCallback() {
+	c.release(true)
+}
+
+func (c *trackingSSHClient) release(used bool) {
 	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	c.inflightConns--
-	c.mtx.Unlock()
+	if used {
+		c.lastUsed = time.Now()
+	}
+	// finish a delayed CloseWhenFinished once the last connection is gone:
+	if c.shouldClose && c.inflightConns <= 0 {
+		log.Trace("closing ssh transport connection after last active connection")
+		_ = c.Close()
+	}
+}
+
+// forceClose closes the client right away, aborting all inflight channels.
+func (c *trackingSSHClient) forceClose() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.shouldClose = true
+	return c.Close()
 }
 
 func (c *trackingSSHClient) CloseWhenFinished() error {
@@ -186,34 +235,96 @@ func (c *trackingSSHClient) CloseWhenFinished() error {
 	return err
 }
 
-func NewSSHTransport(user, keyFile, knownHostsFile string, port int, nextProxyAddr string) (*sshTransport, error) {
+func NewSSHTransport(config *config, nextProxyAddrs []string) (*sshTransport, error) {
 	t := &sshTransport{
-		port:           port,
-		sshClientPool:  newSSHClientPool(),
-		keyFile:        keyFile,
-		knownHostsFile: knownHostsFile,
-		user:           user,
-		nextProxyAddr:  nextProxyAddr,
-	}
-	err := t.LoadFiles()
+		nextProxyAddrs:   nextProxyAddrs,
+		sshClientPool:    newSSHClientPool(),
+		backoffs:         newHostBackoffs(*sshBackoffMin, *sshBackoffMax),
+		handshakeLimiter: newHandshakeLimiter(*sshMaxConcurrentHandshakes, *sshHandshakeRate),
+	}
+	state, err := newSSHState(config, nextProxyAddrs, nil)
 	if err != nil {
 		return nil, err
 	}
+	t.state.Store(state)
+	metricSSHCertificateValidity.Set(state.files.certs)
 	t.createTransports()
+	if *sshIdleTimeout > 0 || *sshMaxAge > 0 {
+		go t.evictExpiredClients(*sshIdleTimeout, *sshMaxAge)
+	}
+	if *sshKeepaliveInterval > 0 {
+		go t.probeIdleClients(*sshKeepaliveInterval)
+	}
 	return t, nil
 }
 
-func (t *sshTransport) LoadFiles() error {
-	auth, err := makePubkeyAuth(t.keyFile)
+// loadSSHFiles reads all key and known hosts files referenced by the config.
+func loadSSHFiles(c *config) (*sshFiles, error) {
+	files := &sshFiles{
+		keyFiles:   make(map[string][]string),
+		signers:    make(map[string]ssh.Signer),
+		certs:      make(map[string]*ssh.Certificate),
+		knownHosts: make(map[string]*knownHosts),
+	}
+	for _, settings := range c.allTargetConfigs() {
+		for _, keyPath := range settings.KeyFiles {
+			if _, expanded := files.keyFiles[keyPath]; expanded {
+				continue
+			}
+			keyFiles, err := expandKeyPath(keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load private key file: %s", err)
+			}
+			files.keyFiles[keyPath] = keyFiles
+			for _, keyFile := range keyFiles {
+				if err := files.loadKey(keyFile, settings.KeyPassphraseFile); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for _, certFile := range c.certFiles() {
+		cert, err := loadCertificate(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate file: %s", err)
+		}
+		files.certs[certFile] = cert
+	}
+	for _, settings := range c.allTargetConfigs() {
+		if _, err := keySigners(settings, files); err != nil {
+			return nil, err
+		}
+	}
+	for _, knownHostsFile := range c.knownHostsFiles() {
+		knownHosts, err := loadKnownHosts(knownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known hosts: %s", err)
+		}
+		files.knownHosts[knownHostsFile] = knownHosts
+	}
+	return files, nil
+}
+
+// loadKey loads the given private key file along with its
+// certificate, if one exists next to it.
+func (files *sshFiles) loadKey(keyFile, passphraseFile string) error {
+	if _, loaded := files.signers[keyFile]; loaded {
+		return nil
+	}
+	signer, err := loadPrivateKey(keyFile, passphraseFile)
 	if err != nil {
 		return fmt.Errorf("failed to load private key file: %s", err)
 	}
-	t.auth = auth
-	knownHostsCallback, err := knownhosts.New(t.knownHostsFile)
-	if err != nil {
-		return fmt.Errorf("failed to load known hosts: %s", err)
+	files.signers[keyFile] = signer
+	// certificates next to the key file are optional:
+	certFile := autoCertFile(keyFile)
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := loadCertificate(certFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate file: %s", err)
+		}
+		files.certs[certFile] = cert
 	}
-	t.knownHostsCallback = knownHostsCallback
 	return nil
 }
 
@@ -230,6 +341,7 @@ func (t *sshTransport) createTransports() {
 	transportTLSSkipVerify.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	t.TransportRegular = transportRegular
 	t.TransportTLSSkipVerify = transportTLSSkipVerify
+	t.TransportUnixSocket = t.newUnixSocketTransport()
 }
 
 func (t *sshTransport) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
@@ -242,33 +354,118 @@ func (t *sshTransport) dialContext(ctx context.Context, network, addr string) (n
 		log.WithFields(log.Fields{"network": network, "addr": addr}).Error("network type not supported")
 		return nil, fmt.Errorf("network type %s is not supported", network)
 	}
-	if t.nextProxyAddr != "" {
-		addr = t.nextProxyAddr
+	conn, _, err := t.dialRoute(ctx, addr)
+	return conn, err
+}
+
+// isFinalHop reports whether requests to the given host are handled by
+// this sshified instance rather than by a next proxy.
+func (t *sshTransport) isFinalHop(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return t.state.Load().router.routeFor(host).isDirect()
+}
+
+// dialRoute connects to addr either directly or via one of the next
+// proxies of the matching route, failing over to the next one if a next
+// proxy cannot be reached.
+// It reports whether the connection leads to a next proxy.
+func (t *sshTransport) dialRoute(ctx context.Context, addr string) (net.Conn, bool, error) {
+	targetHost, _, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil {
+		metricErrorsByType.WithLabelValues("address_parsing").Inc()
+		return nil, false, errors.New("failed to parse address")
+	}
+	route := t.state.Load().router.routeFor(targetHost)
+	if route.isDirect() {
+		conn, err := t.dialAddr(ctx, addr)
+		return conn, false, err
+	}
+	var err error
+	for _, nextProxy := range route.failoverOrder() {
+		var conn net.Conn
+		conn, err = t.dialAddr(ctx, nextProxy.addr)
+		nextProxy.markResult(err)
+		if err == nil {
+			return conn, true, nil
+		}
+		metricErrorsByType.WithLabelValues("next_proxy").Inc()
+		log.WithFields(log.Fields{"addr": addr, "nextProxy": nextProxy.addr, "err": err}).Debug("next proxy failed, trying next one")
+		select {
+		case <-ctx.Done():
+			return nil, true, context.Cause(ctx)
+		default:
+		}
 	}
+	return nil, true, err
+}
+
+// dialAddr connects to the port of addr on the host of addr via ssh.
+func (t *sshTransport) dialAddr(ctx context.Context, addr string) (net.Conn, error) {
 	targetHost, targetPort, splitErr := net.SplitHostPort(addr)
 	if splitErr != nil {
 		metricErrorsByType.WithLabelValues("address_parsing").Inc()
 		return nil, errors.New("failed to parse address")
 	}
+	settings := t.state.Load().config.forHost(strings.ToLower(targetHost))
+	var remotes []remoteAddr
+	for _, host := range settings.remoteDestinations() {
+		network := settings.remoteNetwork()
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			network = "tcp4"
+		} else if ip != nil {
+			network = "tcp6"
+		}
+		remotes = append(remotes, remoteAddr{network: network, addr: net.JoinHostPort(host, targetPort)})
+	}
+	return t.dialRemote(ctx, targetHost, remotes...)
+}
+
+// remoteAddr is an address as seen from the target host.
+type remoteAddr struct {
+	network, addr string
+}
+
+// dialRemote opens a connection to the first of the given remote
+// addresses which accepts it over the SSH connection to targetHost.
+// If this fails, the SSH connection is checked using a keepalive and
+// re-established once if it turns out to be dead.
+func (t *sshTransport) dialRemote(ctx context.Context, targetHost string, remotes ...remoteAddr) (net.Conn, error) {
 	var err error
 	for attempt := 1; attempt <= 2; attempt++ {
 		var client *trackingSSHClient
 		// ensure that err is assigned properly, no := here:
 		client, err = t.getSSHClient(targetHost)
+		var backoffErr *backoffError
+		if errors.As(err, &backoffErr) {
+			metricErrorsByType.WithLabelValues("backoff").Inc()
+			return nil, err
+		}
 		if err != nil {
 			metricErrorsByType.WithLabelValues("ssh_connection").Inc()
-			return nil, fmt.Errorf("failed to obtain ssh connection: %s", err)
+			return nil, fmt.Errorf("failed to obtain ssh connection: %w", err)
 		}
-		log.WithFields(log.Fields{"port": targetPort}).Trace("connecting")
-		// it's important to choose a smaller timeout here than our caller.
-		// otherwise, we might never get a chance to mark the connection as dead,
-		// run the keepalive check and force a reconnect:
-		dialCtx, dialCancel := context.WithTimeout(ctx, stepTimeoutDurationSeconds)
-		conn, err := client.DialContext(dialCtx, "tcp4", net.JoinHostPort("127.0.0.1", targetPort))
-		dialCancel()
-		log.WithFields(log.Fields{"port": targetPort, "err": err}).Trace("done")
-		if err == nil {
-			return conn, nil
+		var conn net.Conn
+		for _, remote := range remotes {
+			log.WithFields(log.Fields{"network": remote.network, "addr": remote.addr}).Trace("connecting")
+			// it's important to choose a smaller timeout here than our caller.
+			// otherwise, we might never get a chance to mark the connection as dead,
+			// run the keepalive check and force a reconnect:
+			dialCtx, dialCancel := context.WithTimeout(ctx, stepTimeoutDurationSeconds)
+			conn, err = client.DialContext(dialCtx, remote.network, remote.addr)
+			dialCancel()
+			log.WithFields(log.Fields{"network": remote.network, "addr": remote.addr, "err": err}).Trace("done")
+			if err == nil {
+				return conn, nil
+			}
+			// only fall back to the next address if the target explicitly
+			// refused this one, everything else is checked below:
+			var openErr *ssh.OpenChannelError
+			if !errors.As(err, &openErr) {
+				break
+			}
 		}
 		log.WithFields(log.Fields{"host": targetHost, "err": err}).Debug("connection failed, sending keepalive")
 		// ensure that the request is still valid at all:
@@ -282,31 +479,71 @@ func (t *sshTransport) dialContext(ctx context.Context, network, addr string) (n
 			log.WithFields(log.Fields{"host": targetHost}).Debug("keepalive worked, this is not an ssh conn problem")
 			return nil, err
 		}
-		metricErrorsByType.WithLabelValues("ssh_keepalive_failure").Inc()
 		log.WithFields(log.Fields{"host": targetHost, "err": err, "attempt": attempt}).Debug("keepalive failed")
-		t.sshClientPool.delete(targetHost)
-		// Don't close right away, there might still be inflight
-		// requests which would otherwise crash as they reference
-		// invalid memory:
-		_ = client.CloseWhenFinished()
-		metricSSHKeepaliveFailuresTotal.Inc()
+		t.evictDeadClient(targetHost, client)
 	}
 	return nil, err
 }
 
+// evictDeadClient removes a client whose keepalive failed from the pool
+// along with all clients which have been connected through it.
+func (t *sshTransport) evictDeadClient(host string, client *trackingSSHClient) {
+	metricErrorsByType.WithLabelValues("ssh_keepalive_failure").Inc()
+	t.sshClientPool.delete(host, client)
+	// Don't close right away, there might still be inflight
+	// requests which would otherwise crash as they reference
+	// invalid memory:
+	_ = client.CloseWhenFinished()
+	metricSSHClientEvictionsTotal.WithLabelValues("keepalive_failure").Inc()
+	// connections which have been established via this client
+	// are broken as well:
+	for dependent, dependentHost := range t.sshClientPool.deleteDependents(client) {
+		log.WithFields(log.Fields{"host": dependentHost, "jumpHost": host}).Debug("dropping ssh connection via failed jump host")
+		_ = dependent.CloseWhenFinished()
+		metricSSHClientEvictionsTotal.WithLabelValues("jump_host_failure").Inc()
+	}
+	metricSSHKeepaliveFailuresTotal.Inc()
+}
+
+// dialTunnel opens a raw connection to addr for tunneling clients (e.g. CONNECT).
+// If the route uses a next proxy, the next sshified is asked to establish
+// the tunnel using CONNECT as well.
+func (t *sshTransport) dialTunnel(ctx context.Context, addr string) (net.Conn, error) {
+	conn, viaNextProxy, err := t.dialRoute(ctx, addr)
+	if err != nil || !viaNextProxy {
+		return conn, err
+	}
+	tunnelConn, err := connectViaProxy(ctx, conn, addr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tunnelConn, nil
+}
+
 // getHostkeyAlgosFor queries the knownhosts database for the given hostport with an invalid
 // key to match against. This generates an error which can be used to query for the
 // available key type algorithms.
-func (t *sshTransport) getHostkeyAlgosFor(hostport string) ([]string, error) {
+// Matching @cert-authority entries are reported as well. The host certificate
+// algorithms are advertised for them, preferring certificates over plain keys.
+func getHostkeyAlgosFor(hostport string, knownHosts *knownHosts) ([]string, error) {
 	placeholderAddr := &net.TCPAddr{IP: []byte{0, 0, 0, 0}}
 	var placeholderPubkey invalidPublicKey
 	var algos []string
+	var certAuthorityFound bool
 	var knownHostsLookupError *knownhosts.KeyError
-	if err := t.knownHostsCallback(hostport, placeholderAddr, &placeholderPubkey); errors.As(err, &knownHostsLookupError) {
+	if err := knownHosts.callback(hostport, placeholderAddr, &placeholderPubkey); errors.As(err, &knownHostsLookupError) {
 		for _, knownKey := range knownHostsLookupError.Want {
+			if knownHosts.isCertAuthority(knownKey) {
+				certAuthorityFound = true
+				continue
+			}
 			algos = append(algos, knownKey.Key.Type())
 		}
 	}
+	if certAuthorityFound {
+		algos = append(certHostKeyAlgos[:len(certHostKeyAlgos):len(certHostKeyAlgos)], algos...)
+	}
 	if len(algos) < 1 {
 		metricErrorsByType.WithLabelValues("ssh_host_key_unknown").Inc()
 		return []string{}, fmt.Errorf("no matching known hosts entry for %s", hostport)
@@ -316,45 +553,132 @@ func (t *sshTransport) getHostkeyAlgosFor(hostport string) ([]string, error) {
 
 func (t *sshTransport) getSSHClient(host string) (*trackingSSHClient, error) {
 	host = strings.ToLower(host)
-	client, cached := t.sshClientPool.get(host)
-	if cached {
+	client, clients := t.sshClientPool.get(host)
+	if client != nil {
+		settings := t.state.Load().config.forHost(host)
+		if clients < settings.MaxConnections && client.inflight() >= int64(settings.ScaleUpThreshold) && t.backoffs.check(host) == nil {
+			// the existing connections can still be used while the
+			// additional one is being established:
+			log.WithFields(log.Fields{"host": host, "connections": clients}).Debug("establishing additional ssh connection")
+			t.sshClientPool.startDial(host, func() (*trackingSSHClient, error) {
+				return t.connectSSHClient(host)
+			})
+		}
 		log.WithFields(log.Fields{"host": host}).Trace("using cached ssh connection")
 		return client, nil
 	}
-	sshAddr := net.JoinHostPort(host, strconv.Itoa(t.port))
-	knownHostAlgos, err := t.getHostkeyAlgosFor(sshAddr)
+	// fail fast for hosts which could not be connected to recently:
+	if err := t.backoffs.check(host); err != nil {
+		return nil, err
+	}
+	// concurrent requests for the same host share a single connection attempt:
+	return t.sshClientPool.dialOnce(host, func() (*trackingSSHClient, error) {
+		return t.connectSSHClient(host)
+	})
+}
+
+// connectSSHClient calls newSSHClient and tracks the result for backoff purposes.
+func (t *sshTransport) connectSSHClient(host string) (*trackingSSHClient, error) {
+	client, err := t.newSSHClient(host)
+	if err != nil {
+		if !errors.Is(err, errHandshakeQueueTimeout) {
+			t.backoffs.failed(host)
+		}
+		return nil, err
+	}
+	t.backoffs.succeeded(host)
+	return client, nil
+}
+
+// newSSHClient establishes a new ssh connection to host and adds it to the pool.
+func (t *sshTransport) newSSHClient(host string) (*trackingSSHClient, error) {
+	state := t.state.Load()
+	if _, err := state.config.jumpHosts(host); err != nil {
+		return nil, err
+	}
+	settings := state.config.forHost(host)
+	if settings.User == "" || settings.KnownHostsFile == "" {
+		return nil, fmt.Errorf("incomplete ssh settings for %s: user and known hosts file are required", host)
+	}
+	knownHosts := state.files.knownHosts[settings.KnownHostsFile]
+	sshHost := host
+	if settings.HostName != "" {
+		sshHost = settings.HostName
+	}
+	sshAddr := net.JoinHostPort(sshHost, strconv.Itoa(settings.Port))
+	knownHostAlgos, err := getHostkeyAlgosFor(sshAddr, knownHosts)
 	if err != nil {
 		return nil, err
 	}
 	upgradedHostKeyAlgos := upgradeHostKeyAlgos(knownHostAlgos)
-	log.WithFields(log.Fields{"host": host, "HostKeyAlgorithms": upgradedHostKeyAlgos}).Trace("building ssh connection")
+	log.WithFields(log.Fields{"host": host, "hostName": sshHost, "user": settings.User, "port": settings.Port, "jumpHost": settings.ProxyJump, "HostKeyAlgorithms": upgradedHostKeyAlgos}).Trace("building ssh connection")
+	auth, authKey := state.authFor(settings)
+	var hostKey ssh.PublicKey
 	clientConfig := &ssh.ClientConfig{
-		User:              t.user,
-		Auth:              t.auth,
-		HostKeyCallback:   t.knownHostsCallback,
+		User: settings.User,
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if err := knownHosts.callback(hostname, remote, key); err != nil {
+				return err
+			}
+			hostKey = key
+			return nil
+		},
 		HostKeyAlgorithms: upgradedHostKeyAlgos,
-		Timeout:           stepTimeoutDurationSeconds,
+		Timeout:           settings.ConnectTimeout,
 	}
-	conn, err := net.DialTimeout("tcp", sshAddr, clientConfig.Timeout)
+	// connections via a jump host are opened before taking a handshake
+	// slot: (re-)establishing the jump host connection needs a slot
+	// itself, which might otherwise all be held by targets waiting for it.
+	var conn net.Conn
+	if settings.ProxyJump != "" {
+		conn, err = t.dialSSH(settings, sshAddr)
+		if err != nil {
+			log.WithFields(log.Fields{"host": host, "err": err}).Trace("connection via jump host failed")
+			return nil, err
+		}
+	}
+	// the queue wait, connect and handshake all have to fit into the
+	// request timeout:
+	queueCtx, queueCancel := context.WithTimeout(context.Background(), stepTimeoutDurationSeconds)
+	releaseHandshake, err := t.handshakeLimiter.acquire(queueCtx)
+	queueCancel()
 	if err != nil {
-		log.WithFields(log.Fields{"host": host, "err": err}).Trace("TCP connection failed")
+		if conn != nil {
+			_ = conn.Close()
+		}
+		metricErrorsByType.WithLabelValues("ssh_handshake_queue_timeout").Inc()
 		return nil, err
 	}
-	c, chans, reqs, err := ssh.NewClientConn(conn, sshAddr, clientConfig)
+	defer releaseHandshake()
+	if conn == nil {
+		conn, err = t.dialSSH(settings, sshAddr)
+		if err != nil {
+			log.WithFields(log.Fields{"host": host, "err": err}).Trace("TCP connection failed")
+			return nil, err
+		}
+	}
+	c, chans, reqs, err := handshakeSSH(conn, sshAddr, clientConfig, settings.ConnectTimeout)
 	if err != nil {
 		log.WithFields(log.Fields{"host": host, "err": err}).Trace("SSH connection failed")
 		return nil, err
 	}
 	plainClient := ssh.NewClient(c, chans, reqs)
+	log.WithFields(log.Fields{"host": host, "key": authKey.Name()}).Info("ssh authentication succeeded")
+	metricSSHAuthKeyAcceptedTotal.WithLabelValues(authKey.Name()).Inc()
 
 	log.WithFields(log.Fields{"host": host}).Trace("caching successful ssh connection")
-	client = &trackingSSHClient{Client: plainClient, Conn: conn}
-	cachedClient, cached := t.sshClientPool.setOrGetCached(host, client)
-	if cached {
-		// we already checked above and did not have a cached client.
-		// however, due to concurrent requests, we may now have one.
+	now := time.Now()
+	client := &trackingSSHClient{Client: plainClient, Conn: conn, sshAddr: sshAddr, hostKey: hostKey, createdAt: now, lastUsed: now}
+	if jumpConn, ok := conn.(*trackingSSHConn); ok {
+		client.jumpClient = jumpConn.client
+	}
+	cachedClient, added := t.sshClientPool.add(host, client, settings.MaxConnections)
+	if !added {
+		// getSSHClient already checked and did not find enough cached clients.
+		// however, due to concurrent requests, we may now have them.
 		// apparently this is the case here.
-		// therefore, we drop our newly created client and use the cached one
+		// therefore, we drop our newly created client and use a cached one
 		// instead.
 		_ = client.Close()
 		client = cachedClient
@@ -362,6 +686,47 @@ func (t *sshTransport) getSSHClient(host string) (*trackingSSHClient, error) {
 	return client, nil
 }
 
+// handshakeSSH establishes an ssh connection on conn. The handshake is
+// aborted after timeout, as ssh.ClientConfig.Timeout only applies to
+// ssh.Dial. Otherwise, a server which stalls the handshake would hold
+// its handshake slot until the TCP connection times out.
+func handshakeSSH(conn net.Conn, sshAddr string, clientConfig *ssh.ClientConfig, timeout time.Duration) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	var timer *time.Timer
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		// channels via a jump host do not support deadlines:
+		timer = time.AfterFunc(timeout, func() { _ = conn.Close() })
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, sshAddr, clientConfig)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			_ = c.Close()
+		}
+		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: timed out after %s", timeout)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return c, chans, reqs, nil
+}
+
+// dialSSH opens the connection to the SSH server at sshAddr, either
+// directly or through a direct-tcpip channel on the (pooled) connection
+// to the configured jump host.
+func (t *sshTransport) dialSSH(settings targetConfig, sshAddr string) (net.Conn, error) {
+	if settings.ProxyJump == "" {
+		return net.DialTimeout("tcp", sshAddr, settings.ConnectTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), settings.ConnectTimeout)
+	defer cancel()
+	conn, err := t.dialRemote(ctx, settings.ProxyJump, remoteAddr{network: "tcp", addr: sshAddr})
+	if err != nil {
+		metricErrorsByType.WithLabelValues("ssh_jump_host").Inc()
+		return nil, fmt.Errorf("failed to connect via jump host %s: %s", settings.ProxyJump, err)
+	}
+	return conn, nil
+}
+
 // When reading known_host files we find key types such as ssh-rsa.
 // When talking to an SSH server, we need to advertise what keys we
 // can handle.
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// unixSocketParam is the query parameter used for addressing a Unix
+// socket on the target host instead of a TCP port.
+const unixSocketParam = "__sshified_unix_socket"
+
+// unixSocketPatterns is a list of glob patterns for remote Unix socket
+// paths which may be accessed.
+type unixSocketPatterns []string
+
+// parseUnixSocketPatterns validates the given glob patterns.
+func parseUnixSocketPatterns(patterns []string) (unixSocketPatterns, error) {
+	for _, pattern := range patterns {
+		if !path.IsAbs(pattern) {
+			return nil, fmt.Errorf("pattern %q is not an absolute path", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return unixSocketPatterns(patterns), nil
+}
+
+// allows reports whether socketPath matches one of the patterns.
+// Only absolute, clean paths are accepted to avoid escaping the allowed
+// directories using "..".
+func (patterns unixSocketPatterns) allows(socketPath string) bool {
+	if !path.IsAbs(socketPath) || path.Clean(socketPath) != socketPath {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, socketPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+type unixSocketCtxKey struct{}
+
+// withUnixSocket returns a context which makes dialUnixSocket connect
+// to the given remote socket path.
+func withUnixSocket(ctx context.Context, socketPath string) context.Context {
+	return context.WithValue(ctx, unixSocketCtxKey{}, socketPath)
+}
+
+// newUnixSocketTransport returns a transport which connects to the Unix
+// socket stored in the request context.
+// Keep-alives are disabled as idle connections are pooled by host:port
+// only and could otherwise be reused for requests to a different socket.
+func (t *sshTransport) newUnixSocketTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 nil,
+		DialContext:           t.dialUnixSocket,
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: timeoutDurationSeconds,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+func (t *sshTransport) dialUnixSocket(ctx context.Context, network, addr string) (net.Conn, error) {
+	socketPath, ok := ctx.Value(unixSocketCtxKey{}).(string)
+	if !ok {
+		return nil, fmt.Errorf("no unix socket given for %s", addr)
+	}
+	targetHost, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		metricErrorsByType.WithLabelValues("address_parsing").Inc()
+		return nil, fmt.Errorf("failed to parse address")
+	}
+	log.WithFields(log.Fields{"host": targetHost, "socket": socketPath}).Trace("connecting to unix socket")
+	return t.dialRemote(ctx, targetHost, remoteAddr{network: "unix", addr: socketPath})
+}
+
+// prepareUnixSocket handles the unixSocketParam query parameter.
+// It is left untouched in cascading mode so that the last sshified
+// instance handles it.
+func (pr *proxyRequest) prepareUnixSocket() error {
+	if pr.transportUnixSocket == nil {
+		return nil
+	}
+	values := pr.origReq.URL.Query()
+	if !values.Has(unixSocketParam) {
+		return nil
+	}
+	socketPath := values.Get(unixSocketParam)
+	values.Del(unixSocketParam)
+	pr.origReq.URL.RawQuery = values.Encode()
+	if !unixSocketAllowedPaths.allows(socketPath) {
+		metricErrorsByType.WithLabelValues("unix_socket_denied").Inc()
+		http.Error(pr.rw, "access to this unix socket is not allowed", http.StatusForbidden)
+		return fmt.Errorf("access to unix socket %s is not allowed", socketPath)
+	}
+	pr.unixSocket = socketPath
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// watchDebounce is the time to wait for further changes before reloading,
+// so that a burst of writes results in a single reload.
+const watchDebounce = time.Second
+
+// fileWatcher triggers a reload when one of the watched files changes.
+// Where available, inotify is used on the directories containing the
+// files, which also catches files being replaced atomically by a rename.
+// Otherwise, the files are polled.
+// In both cases, a reload is only triggered if the modification time,
+// size or identity (inode) of a watched file actually changed.
+type fileWatcher struct {
+	files        func() []string
+	reload       func()
+	pollInterval time.Duration
+	dirs         *dirWatcher
+	stamps       map[string]os.FileInfo
+}
+
+// watchFiles runs a fileWatcher for the files returned by files.
+// The list of files is refreshed after each reload.
+func watchFiles(files func() []string, reload func(), pollInterval time.Duration) {
+	w := &fileWatcher{files: files, reload: reload, pollInterval: pollInterval}
+	dirs, err := newDirWatcher()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "pollInterval": pollInterval}).Info("inotify not available, polling watched files")
+	} else {
+		w.dirs = dirs
+	}
+	w.stamps = w.stat()
+	w.run()
+}
+
+func (w *fileWatcher) run() {
+	var events <-chan struct{}
+	var poll <-chan time.Time
+	// polled is the state seen by the last poll, a reload is only
+	// triggered once the files did not change between two polls:
+	polled := w.stamps
+	if w.dirs != nil {
+		events = w.dirs.events
+	} else {
+		ticker := time.NewTicker(w.pollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case <-events:
+			debounce.Reset(watchDebounce)
+		case <-poll:
+			stamps := w.stat()
+			if len(changedFiles(polled, stamps)) > 0 {
+				debounce.Reset(watchDebounce)
+			}
+			polled = stamps
+		case <-debounce.C:
+			changed := changedFiles(w.stamps, w.stat())
+			if len(changed) == 0 {
+				continue
+			}
+			log.WithFields(log.Fields{"files": changed}).Info("watched files changed, reloading configuration")
+			w.reload()
+			// the set of files might have changed with the config:
+			w.stamps = w.stat()
+			polled = w.stamps
+		}
+	}
+}
+
+// stat returns the current state of all watched files (nil for files
+// which do not exist). With inotify, the containing directories are
+// watched as well.
+func (w *fileWatcher) stat() map[string]os.FileInfo {
+	stamps := make(map[string]os.FileInfo)
+	for _, file := range w.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			info = nil
+		}
+		stamps[file] = info
+		if w.dirs == nil {
+			continue
+		}
+		w.dirs.add(filepath.Dir(file))
+		if info != nil && info.IsDir() {
+			w.dirs.add(file)
+		}
+	}
+	return stamps
+}
+
+// changedFiles returns the files whose state differs from the previous one.
+func changedFiles(previousStamps, stamps map[string]os.FileInfo) []string {
+	var changed []string
+	for file, info := range stamps {
+		previous, known := previousStamps[file]
+		if !known || fileChanged(previous, info) {
+			changed = append(changed, file)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// watchedFiles returns the key, certificate and known hosts files of the
+// current config. Key directories are included as well, as are the
+// certificate files which would be picked up next to the keys.
+func (t *sshTransport) watchedFiles() []string {
+	files := t.state.Load().files
+	var paths []string
+	for keyPath, keyFiles := range files.keyFiles {
+		paths = append(paths, keyPath)
+		for _, keyFile := range keyFiles {
+			paths = append(paths, keyFile, autoCertFile(keyFile))
+		}
+	}
+	for certFile := range files.certs {
+		paths = append(paths, certFile)
+	}
+	for knownHostsFile := range files.knownHosts {
+		paths = append(paths, knownHostsFile)
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+func fileChanged(previous, current os.FileInfo) bool {
+	if previous == nil || current == nil {
+		return previous != current
+	}
+	return !os.SameFile(previous, current) || !previous.ModTime().Equal(current.ModTime()) || previous.Size() != current.Size()
+}
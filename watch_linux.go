@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+	unix.IN_DELETE | unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// dirWatcher signals changes in the watched directories using inotify.
+// Events are not distinguished, they only trigger a check of the
+// watched files.
+type dirWatcher struct {
+	fd     int
+	f      *os.File
+	events chan struct{}
+	mtx    sync.Mutex
+	dirs   map[string]bool
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %s", err)
+	}
+	w := &dirWatcher{
+		fd:     fd,
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan struct{}, 1),
+		dirs:   make(map[string]bool),
+	}
+	go w.read()
+	return w, nil
+}
+
+// add watches dir unless it is already being watched.
+// Directories which do not exist (yet) are retried on the next call.
+func (w *dirWatcher) add(dir string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.dirs[dir] {
+		return
+	}
+	if _, err := unix.InotifyAddWatch(w.fd, dir, inotifyMask); err != nil {
+		log.WithFields(log.Fields{"dir": dir, "err": err}).Debug("unable to watch directory")
+		return
+	}
+	w.dirs[dir] = true
+}
+
+func (w *dirWatcher) read() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		if _, err := w.f.Read(buf); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("reading inotify events failed, watching files stopped")
+			return
+		}
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// dirWatcher is only implemented for Linux, files are polled elsewhere.
+type dirWatcher struct {
+	events chan struct{}
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	return nil, errors.New("not supported on this platform")
+}
+
+func (w *dirWatcher) add(dir string) {}